@@ -65,6 +65,14 @@ interface JoinRoom {
   type: "join-room";
   code: string;
   user?: User;
+  token?: string;
+}
+
+interface UserToken {
+  type: "user-token";
+  code: string;
+  userId: string;
+  token: string;
 }
 
 interface PingMessage {
@@ -162,7 +170,8 @@ type Message =
   | UsersSync
   | UserActivity
   | MediaMessage
-  | MediaSync;
+  | MediaSync
+  | UserToken;
 
 const WS_URL = `${process.env.NEXT_PUBLIC_WS_URL}`;
 
@@ -228,6 +237,31 @@ const saveUser = (user: User) => {
   }
 };
 
+// The server issues a token for each user ID, which must be sent back to
+// keep using that ID
+const restoreToken = (userId: string): string | undefined => {
+  if (typeof window === 'undefined') return undefined;
+  try {
+    const stored = getCookie("osborne-token");
+    if (stored) {
+      const parsed = JSON.parse(stored);
+      if (parsed.userId === userId) return parsed.token;
+    }
+  } catch (error) {
+    console.error('Error loading token from storage:', error);
+  }
+  return undefined;
+};
+
+const saveToken = (userId: string, token: string) => {
+  if (typeof window === 'undefined') return;
+  try {
+    setCookie("osborne-token", JSON.stringify({ userId, token }), 30); // 30 days
+  } catch (error) {
+    console.error('Error saving token to storage:', error);
+  }
+};
+
 let filesCopy: Array<File>;
 
 const Room = () => {
@@ -510,6 +544,7 @@ const Room = () => {
         type: "join-room",
         code: roomCode,
         user: user,
+        token: restoreToken(user.id),
       };
       ws.send(JSON.stringify(message));
     };
@@ -518,6 +553,17 @@ const Room = () => {
       const message: Message = JSON.parse(event.data);
 
       switch (message.type) {
+        case "user-token":
+          // Sent when the server issues a token, possibly for a new ID
+          saveToken(message.userId, message.token);
+          if (currentUserRef.current && currentUserRef.current.id !== message.userId) {
+            const user = { ...currentUserRef.current, id: message.userId };
+            currentUserRef.current = user;
+            setCurrentUser(user);
+            saveUser(user);
+          }
+          break;
+
         case "initial-content":
         case "text-update":
           if (message.content !== contentRef.current) {
@@ -771,12 +817,14 @@ const Room = () => {
   };
 
   const handlePurgeRoom = async () => {
-    if (!roomCode) return;
+    if (!roomCode || !currentUser) return;
     
     try {
       const httpUrl = process.env.NEXT_PUBLIC_HTTP_URL || "http://localhost:8090";
-      const response = await fetch(`${httpUrl}/purge/${roomCode}`, {
+      const userId = encodeURIComponent(currentUser.id);
+      const response = await fetch(`${httpUrl}/purge/${roomCode}?userId=${userId}`, {
         method: "DELETE",
+        headers: { Authorization: `Bearer ${restoreToken(currentUser.id) ?? ""}` },
       });
 
       if (!response.ok) {
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf16"
+)
+
+// lineEdit describes how a single text op moved the document's lines, using
+// 1-based line numbers as comments do. Lines after the edited ones move by
+// Shift; for deletes, lines First..Last of the old text all end up on First.
+type lineEdit struct {
+	First, Last int
+	Shift       int
+	// For inserts: whether line First itself moves down by Shift, which
+	// happens when text is inserted at its very beginning.
+	moveFirst bool
+	// For deletes: whether First and Last lost all of their text.
+	firstDeleted, lastDeleted bool
+}
+
+// lineAt returns the 1-based line and 0-based column of pos in units.
+func lineAt(units []uint16, pos int) (line, col int) {
+	line, start := 1, 0
+	for i := 0; i < pos; i++ {
+		if units[i] == '\n' {
+			line++
+			start = i + 1
+		}
+	}
+	return line, pos - start
+}
+
+// lineLength returns the length in code units of the line starting at start.
+func lineLength(units []uint16, start int) int {
+	n := 0
+	for start+n < len(units) && units[start+n] != '\n' {
+		n++
+	}
+	return n
+}
+
+func countNewlines(units []uint16) int {
+	n := 0
+	for _, u := range units {
+		if u == '\n' {
+			n++
+		}
+	}
+	return n
+}
+
+// alignToLineStart slides op left over repeated text to the start of a line
+// when that gives the same result, so that a whole line diffed as "wo\nt"
+// out of "two\nthree" counts as deleting "two\n".
+func alignToLineStart(units []uint16, op TextOp) TextOp {
+	if op.Type != OpInsert && op.Type != OpDelete {
+		return op
+	}
+	text := utf16.Encode([]rune(op.Text))
+	pos := op.Pos
+	for pos > 0 && units[pos-1] != '\n' {
+		if op.Type == OpInsert {
+			if text[len(text)-1] != units[pos-1] {
+				return op
+			}
+			text = append([]uint16{units[pos-1]}, text[:len(text)-1]...)
+		} else if units[pos-1] != units[pos-1+op.Length] {
+			return op
+		}
+		pos--
+	}
+
+	aligned := op
+	aligned.Pos = pos
+	if op.Type == OpInsert {
+		aligned.Text = string(utf16.Decode(text))
+	}
+	return aligned
+}
+
+// lineEditFor works out how op, applied to units, moves lines. It returns
+// false if op can't change any line's position or text.
+func lineEditFor(units []uint16, op TextOp) (lineEdit, bool) {
+	op = alignToLineStart(units, op)
+	line, col := lineAt(units, op.Pos)
+	switch op.Type {
+	case OpInsert:
+		k := countNewlines(utf16.Encode([]rune(op.Text)))
+		if k == 0 {
+			return lineEdit{}, false
+		}
+		return lineEdit{First: line, Last: line, Shift: k, moveFirst: col == 0}, true
+
+	case OpDelete:
+		deleted := units[op.Pos : op.Pos+op.Length]
+		k := countNewlines(deleted)
+		lineStart := op.Pos - col
+		if k == 0 {
+			// Only a line emptied entirely counts as deleted text.
+			n := lineLength(units, lineStart)
+			if col != 0 || op.Length != n {
+				return lineEdit{}, false
+			}
+			return lineEdit{First: line, Last: line, firstDeleted: true, lastDeleted: true}, true
+		}
+
+		end := op.Pos + op.Length
+		_, endCol := lineAt(units[op.Pos:end], op.Length)
+		lastLen := lineLength(units, end-endCol)
+		return lineEdit{
+			First:        line,
+			Last:         line + k,
+			Shift:        -k,
+			firstDeleted: col == 0,
+			lastDeleted:  lastLen > 0 && endCol == lastLen,
+		}, true
+	}
+	return lineEdit{}, false
+}
+
+// mapLine returns where old line n ends up and whether its text survived.
+func (e lineEdit) mapLine(n int) (int, bool) {
+	if e.Shift > 0 {
+		if n > e.First || (n == e.First && e.moveFirst) {
+			return n + e.Shift, true
+		}
+		return n, true
+	}
+
+	switch {
+	case n < e.First:
+		return n, true
+	case n > e.Last:
+		return n + e.Shift, true
+	case n == e.First:
+		return e.First, !e.firstDeleted
+	case n == e.Last:
+		return e.First, !e.lastDeleted
+	default:
+		return e.First, false
+	}
+}
+
+// mapSpan moves the lines start..end through the edit. If none of their text
+// survived, the span collapses onto where it used to be and alive is false.
+func (e lineEdit) mapSpan(start, end int) (newStart, newEnd int, alive bool) {
+	first, last := -1, -1
+	for n := start; n <= end; {
+		if _, ok := e.mapLine(n); ok {
+			first = n
+			break
+		}
+		// Lines strictly inside a deletion never survive
+		if n > e.First && n < e.Last {
+			n = e.Last
+		} else {
+			n++
+		}
+	}
+	for n := end; n >= start; {
+		if _, ok := e.mapLine(n); ok {
+			last = n
+			break
+		}
+		if n > e.First && n < e.Last {
+			n = e.First
+		} else {
+			n--
+		}
+	}
+
+	if first < 0 {
+		newStart, _ = e.mapLine(start)
+		newEnd, _ = e.mapLine(end)
+		return newStart, newEnd, false
+	}
+	newStart, _ = e.mapLine(first)
+	newEnd, _ = e.mapLine(last)
+	return newStart, newEnd, true
+}
+
+// commentSpan returns the lines a comment is anchored to.
+func commentSpan(comment Comment) (start, end int, ok bool) {
+	if comment.LineNumber == nil {
+		return 0, 0, false
+	}
+	start, end = *comment.LineNumber, *comment.LineNumber
+	if comment.LineRange != nil {
+		var s, e int
+		if n, _ := fmt.Sscanf(*comment.LineRange, "%d-%d", &s, &e); n == 2 && s <= e {
+			start, end = s, e
+		}
+	}
+	return start, end, true
+}
+
+func setCommentSpan(comment *Comment, start, end int) {
+	comment.LineNumber = &start
+	comment.LineRange = nil
+	if end > start {
+		lineRange := fmt.Sprintf("%d-%d", start, end)
+		comment.LineRange = &lineRange
+	}
+}
+
+// remapCommentAnchors moves the room's line comments through ops, which are
+// about to be applied to room.Content, and marks comments whose lines were
+// deleted as outdated. Moved comments are queued for saving and for
+// broadcastMovedComments.
+func (room *Room) remapCommentAnchors(ops []TextOp) {
+	anchored := false
+	for _, comment := range room.Comments {
+		if comment.LineNumber != nil {
+			anchored = true
+			break
+		}
+	}
+	if !anchored {
+		return
+	}
+
+	units := utf16.Encode([]rune(room.Content))
+	for _, op := range ops {
+		if edit, ok := lineEditFor(units, op); ok {
+			for i := range room.Comments {
+				comment := &room.Comments[i]
+				start, end, ok := commentSpan(*comment)
+				if !ok {
+					continue
+				}
+				newStart, newEnd, alive := edit.mapSpan(start, end)
+				if newStart == start && newEnd == end && (alive || comment.Outdated) {
+					continue
+				}
+				setCommentSpan(comment, newStart, newEnd)
+				if !alive {
+					comment.Outdated = true
+				}
+				room.markCommentMoved(comment.ID)
+			}
+		}
+
+		// Advance to the text the next op applies to
+		if op.Type == OpInsert {
+			text := utf16.Encode([]rune(op.Text))
+			next := make([]uint16, 0, len(units)+len(text))
+			next = append(next, units[:op.Pos]...)
+			next = append(next, text...)
+			units = append(next, units[op.Pos:]...)
+		} else {
+			units = append(units[:op.Pos], units[op.Pos+op.Length:]...)
+		}
+	}
+}
+
+func (room *Room) markCommentMoved(commentID string) {
+	if room.movedComments == nil {
+		room.movedComments = make(map[string]bool)
+	}
+	if room.anchorsDirty == nil {
+		room.anchorsDirty = make(map[string]bool)
+	}
+	room.movedComments[commentID] = true
+	room.anchorsDirty[commentID] = true
+}
+
+// broadcastMovedComments sends a comment-update for every comment moved since
+// the last call.
+func (room *Room) broadcastMovedComments() {
+	for _, comment := range room.Comments {
+		if room.movedComments[comment.ID] {
+			broadcastToRoom(room, CommentMessage{
+				BaseMessage: BaseMessage{Type: CommentUpdate, Code: room.Code},
+				Comment:     comment,
+			}, "")
+		}
+	}
+	room.movedComments = nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf16"
+)
+
+func TestRemapCommentAnchors(t *testing.T) {
+	const doc = "one\ntwo\nthree\nfour\nfive\n"
+	const crlf = "one\r\ntwo\r\nthree\r\nfour\r\n"
+	const astral = "😀\n😀😀\nx\n"
+
+	tests := []struct {
+		name       string
+		content    string
+		start, end int
+		ops        []TextOp
+		wantStart  int
+		wantEnd    int
+		outdated   bool
+	}{
+		{"insert line before", doc, 2, 3, []TextOp{ins(0, "x\n")}, 3, 4, false},
+		{"insert text without newline", doc, 2, 3, []TextOp{ins(5, "x")}, 2, 3, false},
+		{"insert lines at span start", doc, 2, 3, []TextOp{ins(4, "x\ny\n")}, 4, 5, false},
+		{"split line inside span", doc, 2, 3, []TextOp{ins(6, "\n")}, 2, 4, false},
+		{"insert at end of span", doc, 2, 3, []TextOp{ins(13, "\nx")}, 2, 3, false},
+		{"insert line after", doc, 2, 3, []TextOp{ins(14, "x\n")}, 2, 3, false},
+		{"inserted line diffed mid-line", doc, 2, 3, []TextOp{ins(6, "o\ntw")}, 3, 4, false},
+		{"delete line before", doc, 2, 3, []TextOp{del(0, 4)}, 1, 2, false},
+		{"delete first line of span", doc, 2, 3, []TextOp{del(4, 4)}, 2, 2, false},
+		{"delete line diffed mid-line", doc, 2, 3, []TextOp{del(5, 4)}, 2, 2, false},
+		{"empty last line of span", doc, 2, 3, []TextOp{del(8, 5)}, 2, 2, false},
+		{"empty single anchored line", doc, 3, 3, []TextOp{del(8, 5)}, 3, 3, true},
+		{"delete whole span", doc, 2, 3, []TextOp{del(4, 10)}, 2, 2, true},
+		{"delete across span lines", doc, 2, 3, []TextOp{del(6, 5)}, 2, 2, false},
+		{"delete across span end", doc, 2, 3, []TextOp{del(12, 4)}, 2, 3, false},
+		{"delete around span", doc, 2, 3, []TextOp{del(2, 14)}, 1, 1, true},
+		{"delete line after", doc, 2, 3, []TextOp{del(14, 5)}, 2, 3, false},
+		{"delete lines before and after", doc, 3, 3, []TextOp{del(0, 8), del(6, 5)}, 1, 1, false},
+		{"replace line before with two", doc, 2, 3, []TextOp{del(0, 4), ins(0, "a\nb\n")}, 3, 4, false},
+		{"replace span", doc, 2, 3, []TextOp{del(4, 10), ins(4, "new\n")}, 3, 3, true},
+		{"crlf delete line before", crlf, 2, 3, []TextOp{del(0, 5)}, 1, 2, false},
+		{"crlf delete first line of span", crlf, 2, 3, []TextOp{del(5, 5)}, 2, 2, false},
+		{"crlf delete line diffed mid-line", crlf, 2, 3, []TextOp{del(6, 5)}, 2, 2, false},
+		{"crlf empty anchored line", crlf, 2, 2, []TextOp{del(5, 4)}, 2, 2, true},
+		{"crlf insert line before", crlf, 2, 3, []TextOp{ins(5, "x\r\n")}, 3, 4, false},
+		{"astral insert line before", astral, 2, 3, []TextOp{ins(3, "😎\n")}, 3, 4, false},
+		{"astral split between pairs", astral, 2, 3, []TextOp{ins(5, "\n")}, 2, 4, false},
+		{"astral delete line before", astral, 2, 3, []TextOp{del(0, 3)}, 1, 2, false},
+		{"astral delete anchored line", astral, 2, 2, []TextOp{del(3, 5)}, 2, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := applyOps(tt.content, tt.ops); !ok {
+				t.Fatalf("ops %v do not apply to %q", tt.ops, tt.content)
+			}
+			comment := Comment{ID: "c"}
+			setCommentSpan(&comment, tt.start, tt.end)
+			room := &Room{Content: tt.content, Comments: []Comment{comment}}
+
+			room.remapCommentAnchors(tt.ops)
+
+			got := room.Comments[0]
+			start, end, _ := commentSpan(got)
+			if start != tt.wantStart || end != tt.wantEnd || got.Outdated != tt.outdated {
+				t.Errorf("got lines %d-%d, outdated %v; want %d-%d, outdated %v", start, end, got.Outdated, tt.wantStart, tt.wantEnd, tt.outdated)
+			}
+			moved := tt.wantStart != tt.start || tt.wantEnd != tt.end || tt.outdated
+			if room.movedComments["c"] != moved || room.anchorsDirty["c"] != moved {
+				t.Errorf("comment marked moved %v, dirty %v; want %v", room.movedComments["c"], room.anchorsDirty["c"], moved)
+			}
+		})
+	}
+}
+
+func TestRemapCommentAnchorsKeepsOutdated(t *testing.T) {
+	comment := Comment{ID: "c", Outdated: true}
+	setCommentSpan(&comment, 2, 2)
+	room := &Room{Content: "one\ntwo\n", Comments: []Comment{comment}}
+
+	room.remapCommentAnchors([]TextOp{ins(4, "\n")})
+	if got := room.Comments[0]; !got.Outdated || *got.LineNumber != 3 {
+		t.Errorf("got line %d, outdated %v; want line 3 still outdated", *got.LineNumber, got.Outdated)
+	}
+
+	room.Content = "one\n\ntwo\n"
+	room.movedComments = nil
+	room.remapCommentAnchors([]TextOp{del(5, 4)})
+	if room.movedComments["c"] {
+		t.Errorf("an outdated comment whose line didn't move was marked moved")
+	}
+}
+
+func TestLineEditFor(t *testing.T) {
+	units := utf16.Encode([]rune("one\ntwo\n\nfour"))
+
+	tests := []struct {
+		name string
+		op   TextOp
+		want lineEdit
+		ok   bool
+	}{
+		{"insert without newline", ins(1, "x"), lineEdit{}, false},
+		{"insert at line start", ins(4, "x\ny\n"), lineEdit{First: 2, Last: 2, Shift: 2, moveFirst: true}, true},
+		{"insert mid-line", ins(5, "\n"), lineEdit{First: 2, Last: 2, Shift: 1}, true},
+		{"delete part of a line", del(4, 2), lineEdit{}, false},
+		{"empty a line", del(4, 3), lineEdit{First: 2, Last: 2, firstDeleted: true, lastDeleted: true}, true},
+		{"delete a line", del(4, 4), lineEdit{First: 2, Last: 3, Shift: -1, firstDeleted: true}, true},
+		{"join lines", del(7, 1), lineEdit{First: 2, Last: 3, Shift: -1}, true},
+		{"delete into an empty line", del(2, 6), lineEdit{First: 1, Last: 3, Shift: -2}, true},
+		{"delete to a line's end", del(3, 4), lineEdit{First: 1, Last: 2, Shift: -1, lastDeleted: true}, true},
+		{"delete through the last line", del(8, 5), lineEdit{First: 3, Last: 4, Shift: -1, firstDeleted: true, lastDeleted: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := lineEditFor(units, tt.op)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got %+v, %v; want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMapSpan(t *testing.T) {
+	// Lines 2 to 5 joined into line 2, with line 2's text kept and line 5's
+	// deleted
+	edit := lineEdit{First: 2, Last: 5, Shift: -3, lastDeleted: true}
+
+	tests := []struct {
+		name       string
+		start, end int
+		wantStart  int
+		wantEnd    int
+		alive      bool
+	}{
+		{"before", 1, 1, 1, 1, true},
+		{"kept first line", 2, 2, 2, 2, true},
+		{"inside", 3, 4, 2, 2, false},
+		{"deleted last line", 5, 5, 2, 2, false},
+		{"from inside to after", 4, 7, 3, 4, true},
+		{"around", 1, 6, 1, 3, true},
+		{"after", 6, 8, 3, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, alive := edit.mapSpan(tt.start, tt.end)
+			if start != tt.wantStart || end != tt.wantEnd || alive != tt.alive {
+				t.Errorf("got %d-%d, %v; want %d-%d, %v", start, end, alive, tt.wantStart, tt.wantEnd, tt.alive)
+			}
+		})
+	}
+}
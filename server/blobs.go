@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Uploaded files are stored once per distinct content under
+// FILES_DIR/.blobs/<first two hex digits>/<sha256>. The blobs table counts the
+// media files referring to each blob, and the blob is removed along with the
+// last of them.
+
+// blobMutex keeps adding and releasing references in step with creating and
+// removing the files they refer to.
+var blobMutex sync.Mutex
+
+func blobPath(hash string) string {
+	return filepath.Join(filesDir, ".blobs", hash[:2], hash)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storeBlob takes a reference to the blob holding the contents of path,
+// which must hash to hash. The file at path is moved into the store if the
+// blob is new and removed otherwise.
+func storeBlob(path, hash string, size int64) error {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	isNew, err := store.AddBlobRef(hash, size)
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		os.Remove(path)
+		return nil
+	}
+
+	dst := blobPath(hash)
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil {
+		err = os.Rename(path, dst)
+	}
+	if err != nil {
+		if _, releaseErr := store.ReleaseBlob(hash); releaseErr != nil {
+			log.Printf("Error releasing blob %s: %v", hash, releaseErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// releaseBlob drops a reference to a blob, removing its file if it was the
+// last one.
+func releaseBlob(hash string) {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	orphaned, err := store.ReleaseBlob(hash)
+	if err != nil {
+		log.Printf("Error releasing blob %s: %v", hash, err)
+		return
+	}
+	if orphaned {
+		if err := os.Remove(blobPath(hash)); err != nil {
+			log.Printf("Warning: Could not delete blob %s: %v", hash, err)
+		}
+		if err := os.Remove(thumbnailPath(hash)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Could not delete thumbnail for blob %s: %v", hash, err)
+		}
+	}
+}
+
+// mediaFilePath returns where the contents of media are kept on disk, or ""
+// if they aren't kept by this server.
+func mediaFilePath(roomCode string, media MediaFile) string {
+	if media.BlobHash != "" {
+		return blobPath(media.BlobHash)
+	}
+	return legacyFilePath(roomCode, media)
+}
+
+// legacyFilePath returns where a file uploaded over HTTP before the blob store
+// was kept, or "" if media isn't one. Those were named <id>_<filename> in the
+// room directory. Anything else, such as media announced over the WebSocket,
+// doesn't name a file of ours however its URL looks.
+func legacyFilePath(roomCode string, media MediaFile) string {
+	name, ok := strings.CutPrefix(media.URL, "/files/"+roomCode+"/")
+	if !ok || !validRoomCode(roomCode) || !strings.HasPrefix(media.ID, "file_") ||
+		!strings.HasPrefix(name, media.ID+"_") || name != filepath.Base(name) {
+		return ""
+	}
+	return filepath.Join(filesDir, roomCode, name)
+}
+
+// deleteMediaFile removes a media file and releases what it refers to.
+func deleteMediaFile(roomCode string, media MediaFile) error {
+	if err := store.DeleteMediaFile(media.ID); err != nil {
+		return err
+	}
+	if media.BlobHash != "" {
+		releaseBlob(media.BlobHash)
+	} else if path := legacyFilePath(roomCode, media); path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Could not delete file %s: %v", media.URL, err)
+		}
+	}
+	return nil
+}
+
+// removeRoomDir deletes a room's directory, which holds files from before
+// the blob store and partial resumable uploads.
+func removeRoomDir(roomCode string) {
+	if !validRoomCode(roomCode) {
+		return
+	}
+	roomDir := filepath.Join(filesDir, roomCode)
+	if err := os.RemoveAll(roomDir); err != nil {
+		log.Printf("Warning: Could not delete room directory %s: %v", roomDir, err)
+	}
+}
+
+// deleteRoomMediaFiles removes all of a room's media files, releasing their
+// blobs.
+func deleteRoomMediaFiles(roomCode string) error {
+	mediaFiles, err := store.GetRoomMedia(roomCode)
+	if err != nil {
+		return err
+	}
+	if err := store.DeleteRoomMedia(roomCode); err != nil {
+		return err
+	}
+	for _, media := range mediaFiles {
+		if media.BlobHash != "" {
+			releaseBlob(media.BlobHash)
+		}
+	}
+	return nil
+}
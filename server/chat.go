@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Chat messages sent per chat-sync page.
+	chatPageSize = 50
+	// Longest chat message accepted, in characters.
+	maxChatLength = 4000
+)
+
+// ChatEntry is one message in a room's chat. Number orders a room's messages
+// and is what chat-sync pages by.
+type ChatEntry struct {
+	ID        string    `json:"id"`
+	Number    int       `json:"number"`
+	Author    string    `json:"author"`
+	AuthorID  string    `json:"authorId"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ChatMessage is sent by a client to post to the room's chat and broadcast
+// to the room once stored.
+type ChatMessage struct {
+	BaseMessage
+	Message ChatEntry `json:"message"`
+}
+
+// ChatSyncMessage carries a page of chat history. Clients send it with Before
+// set to the oldest number they have to fetch the page before it; the server
+// sends the latest page on join.
+type ChatSyncMessage struct {
+	BaseMessage
+	Messages []ChatEntry `json:"messages"`
+	Before   int         `json:"before,omitempty"`
+	HasMore  bool        `json:"hasMore"`
+}
+
+// chatSyncMessage loads the page of roomCode's chat before the given number.
+func chatSyncMessage(roomCode string, before int) (ChatSyncMessage, error) {
+	messages, err := store.GetChatMessages(roomCode, before, chatPageSize+1)
+	if err != nil {
+		return ChatSyncMessage{}, err
+	}
+	hasMore := len(messages) > chatPageSize
+	if hasMore {
+		messages = messages[1:]
+	}
+	if messages == nil {
+		messages = []ChatEntry{}
+	}
+	return ChatSyncMessage{
+		BaseMessage: BaseMessage{Type: ChatSync, Code: roomCode},
+		Messages:    messages,
+		Before:      before,
+		HasMore:     hasMore,
+	}, nil
+}
+
+func handleChatMessage(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
+	}
+
+	var chatMsg ChatMessage
+	if err := json.Unmarshal(message, &chatMsg); err != nil {
+		log.Printf("Error unmarshaling chat message: %v", err)
+		return
+	}
+	content := strings.TrimSpace(chatMsg.Message.Content)
+	if content == "" {
+		return
+	}
+	if utf8.RuneCountInString(content) > maxChatLength {
+		sendError(client, currentRoom, ChatMessageType, fmt.Sprintf("Chat messages are limited to %d characters", maxChatLength))
+		return
+	}
+
+	entry := ChatEntry{
+		ID:        fmt.Sprintf("chat_%d", time.Now().UnixNano()),
+		Content:   content,
+		Timestamp: time.Now(),
+	}
+
+	rooms.do(currentRoom, func(room *Room) {
+		if client, exists := room.Clients[clientID]; exists {
+			entry.Author = client.User.Name
+			entry.AuthorID = client.User.ID
+		}
+
+		number, err := store.SaveChatMessage(currentRoom, entry)
+		if err != nil {
+			log.Printf("Error saving chat message: %v", err)
+			return
+		}
+		entry.Number = number
+
+		broadcastToRoom(room, ChatMessage{
+			BaseMessage: BaseMessage{Type: ChatMessageType, Code: currentRoom},
+			Message:     entry,
+		}, "")
+	})
+}
+
+func handleChatSync(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
+	}
+
+	var syncMsg ChatSyncMessage
+	if err := json.Unmarshal(message, &syncMsg); err != nil {
+		log.Printf("Error unmarshaling chat sync message: %v", err)
+		return
+	}
+
+	page, err := chatSyncMessage(currentRoom, syncMsg.Before)
+	if err != nil {
+		log.Printf("Error loading chat for room %s: %v", currentRoom, err)
+		return
+	}
+	client.send(page)
+}
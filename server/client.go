@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Messages queued for a client before the overflow policy kicks in.
+	clientSendQueueSize = 256
+	// Time allowed to write a single message to a client.
+	clientWriteWait = 10 * time.Second
+)
+
+// Client is one WebSocket connection. Only its writer goroutine writes to
+// Conn; everything else queues messages with send.
+type Client struct {
+	ID          string
+	Conn        *websocket.Conn
+	User        User
+	LastPing    time.Time
+	SupportsOps bool
+	UsesCRDT    bool
+	// CRDTSeq is the latest CRDT seq the client has acknowledged, and
+	// CRDTClient the client ID its CRDT items are created under.
+	CRDTSeq    int
+	CRDTClient string
+
+	queueMutex sync.Mutex
+	queue      []interface{}
+	wake       chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newClient(conn *websocket.Conn) *Client {
+	client := &Client{
+		Conn: conn,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go client.writePump()
+	return client
+}
+
+// isDroppable reports whether a message only carries transient state that a
+// later message will supersede, so it can be shed when a client falls behind.
+func isDroppable(message interface{}) bool {
+	switch message.(type) {
+	case UserActivityMessage:
+		return true
+	}
+	return false
+}
+
+// send queues a message for the client without blocking. When the queue is
+// full the oldest droppable message makes room; if there is none the client is
+// too slow to keep up and gets disconnected.
+func (c *Client) send(message interface{}) {
+	c.queueMutex.Lock()
+	select {
+	case <-c.done:
+		c.queueMutex.Unlock()
+		return
+	default:
+	}
+
+	if len(c.queue) >= clientSendQueueSize {
+		dropped := false
+		for i, queued := range c.queue {
+			if isDroppable(queued) {
+				c.queue = append(c.queue[:i], c.queue[i+1:]...)
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			c.queueMutex.Unlock()
+			if isDroppable(message) {
+				return
+			}
+			log.Printf("Disconnecting slow client %s: send queue full", c.Conn.RemoteAddr())
+			c.close()
+			return
+		}
+	}
+	c.queue = append(c.queue, message)
+	c.queueMutex.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) writePump() {
+	for {
+		select {
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+
+		for {
+			c.queueMutex.Lock()
+			if len(c.queue) == 0 {
+				c.queueMutex.Unlock()
+				break
+			}
+			message := c.queue[0]
+			c.queue = c.queue[1:]
+			c.queueMutex.Unlock()
+
+			c.Conn.SetWriteDeadline(time.Now().Add(clientWriteWait))
+			if err := c.Conn.WriteJSON(message); err != nil {
+				log.Printf("Error writing to client %s: %v", c.Conn.RemoteAddr(), err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close stops the writer and closes the connection, which also ends the
+// reader loop in handleWebSocket.
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		c.queueMutex.Lock()
+		close(c.done)
+		c.queue = nil
+		c.queueMutex.Unlock()
+		c.Conn.Close()
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Longest reaction accepted, in bytes. Enough for flag and ZWJ sequences.
+const maxReactionLength = 32
+
+// orderCommentThreads returns comments grouped into threads: each top-level
+// comment in posting order, directly followed by its replies in posting
+// order. Replies whose parent is missing are kept at the end.
+func orderCommentThreads(comments []Comment) []Comment {
+	roots := make([]Comment, 0, len(comments))
+	replies := make(map[string][]Comment)
+	for _, comment := range comments {
+		if comment.ParentID == nil {
+			roots = append(roots, comment)
+		} else {
+			replies[*comment.ParentID] = append(replies[*comment.ParentID], comment)
+		}
+	}
+
+	byTime := func(list []Comment) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Timestamp.Before(list[j].Timestamp)
+		})
+	}
+	byTime(roots)
+
+	ordered := make([]Comment, 0, len(comments))
+	for _, root := range roots {
+		ordered = append(ordered, root)
+		thread := replies[root.ID]
+		byTime(thread)
+		ordered = append(ordered, thread...)
+		delete(replies, root.ID)
+	}
+
+	var orphans []Comment
+	for _, thread := range replies {
+		orphans = append(orphans, thread...)
+	}
+	byTime(orphans)
+	return append(ordered, orphans...)
+}
+
+// commentsSyncMessage lists the room's comments in thread order, optionally
+// leaving out resolved threads. Deleted comments are only included as
+// tombstones heading a thread that still has replies.
+func commentsSyncMessage(room *Room, hideResolved bool) CommentsMessage {
+	hasReplies := make(map[string]bool)
+	for _, comment := range room.Comments {
+		if comment.ParentID != nil && !comment.Deleted {
+			hasReplies[*comment.ParentID] = true
+		}
+	}
+	comments := orderCommentThreads(room.Comments)
+	live := comments[:0]
+	for _, comment := range comments {
+		if !comment.Deleted || hasReplies[comment.ID] {
+			live = append(live, comment)
+		}
+	}
+	comments = live
+
+	if hideResolved {
+		resolved := make(map[string]bool)
+		visible := comments[:0]
+		for _, comment := range comments {
+			if comment.ParentID == nil {
+				resolved[comment.ID] = comment.Resolved
+			}
+			if comment.Resolved || (comment.ParentID != nil && resolved[*comment.ParentID]) {
+				continue
+			}
+			visible = append(visible, comment)
+		}
+		comments = visible
+	}
+
+	return CommentsMessage{
+		BaseMessage:  BaseMessage{Type: CommentsSync, Code: room.Code},
+		Comments:     comments,
+		HideResolved: hideResolved,
+	}
+}
+
+// findComment returns the index of the comment with the given ID, or -1.
+func findComment(comments []Comment, id string) int {
+	for i, comment := range comments {
+		if comment.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// validEmoji accepts short strings without letters, digits or spaces, which
+// covers emoji including skin tones and ZWJ sequences.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionLength {
+		return false
+	}
+	return !strings.ContainsFunc(emoji, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+// addReaction records userID's emoji on the comment, reporting whether it was
+// new. Reactions are replaced rather than modified in place, since earlier
+// versions may still be queued for sending.
+func (comment *Comment) addReaction(userID, emoji string) bool {
+	reactions := slices.Clone(comment.Reactions)
+	for i, reaction := range reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		if slices.Contains(reaction.UserIDs, userID) {
+			return false
+		}
+		reactions[i].UserIDs = append(slices.Clip(reaction.UserIDs), userID)
+		reactions[i].Count = len(reactions[i].UserIDs)
+		comment.Reactions = reactions
+		return true
+	}
+	comment.Reactions = append(reactions, CommentReaction{Emoji: emoji, Count: 1, UserIDs: []string{userID}})
+	return true
+}
+
+// removeReaction takes back userID's emoji, reporting whether there was one.
+func (comment *Comment) removeReaction(userID, emoji string) bool {
+	reactions := slices.Clone(comment.Reactions)
+	for i, reaction := range reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		j := slices.Index(reaction.UserIDs, userID)
+		if j < 0 {
+			return false
+		}
+		reactions[i].UserIDs = slices.Delete(slices.Clone(reaction.UserIDs), j, j+1)
+		reactions[i].Count = len(reactions[i].UserIDs)
+		if reactions[i].Count == 0 {
+			reactions = slices.Delete(reactions, i, i+1)
+		}
+		comment.Reactions = reactions
+		return true
+	}
+	return false
+}
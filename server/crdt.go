@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Deleted items stay in the sequence as tombstones so that concurrent inserts
+// after them can still be placed. Every batch of deletions bumps the
+// document's seq, which is sent with each crdt-update and crdt-sync, and
+// peers acknowledge the highest seq they have applied with their next
+// crdt-update. The document remembers the seq of every peer that has joined
+// under its CRDT client ID, including ones now offline, which may come back
+// with edits made after tombstones they haven't seen deleted. Once every
+// connected and remembered peer has acknowledged a deletion, none of them can
+// still insert after the tombstone, so it is compacted away. Peers not seen
+// for crdtPeerExpiry are forgotten, so a peer rejoining after that, or
+// without a client ID, may hold references to removed tombstones: it is sent
+// a snapshot to replace its document with, and edits of its that were made
+// after a removed tombstone are lost.
+
+const (
+	// serverCRDTClient is the CRDT client ID the server uses for edits that
+	// arrive through text-update or text-ops rather than as CRDT updates.
+	serverCRDTClient = "server"
+	// Longest client ID accepted in a CRDT item.
+	maxCRDTClientLength = 64
+	// Items and deletes held back waiting for their dependencies, and how far
+	// ahead of a client's state an item's clock may be.
+	maxCRDTPending = 10000
+	// How long an offline peer holds up compaction, and how many peers are
+	// remembered at once.
+	crdtPeerExpiry = 30 * 24 * time.Hour
+	maxCRDTPeers   = 1000
+)
+
+// CRDTID identifies an item by the client that created it and that client's
+// own sequence number, which is what state vectors count.
+type CRDTID struct {
+	Client string `json:"client"`
+	Clock  int    `json:"clock"`
+}
+
+// CRDTItem is one character of an RGA sequence. Lamport orders concurrent
+// inserts after the same origin; Origin is the item it was inserted after,
+// or nil for the start of the document.
+type CRDTItem struct {
+	ID      CRDTID  `json:"id"`
+	Lamport int     `json:"lamport"`
+	Origin  *CRDTID `json:"origin"`
+	Content string  `json:"content"`
+	Deleted bool    `json:"deleted,omitempty"`
+
+	// deletedSeq is the doc's seq when the item was deleted.
+	deletedSeq int
+}
+
+// CRDTUpdate carries new items plus deletions of items the receiver may
+// already have.
+type CRDTUpdate struct {
+	Items   []CRDTItem `json:"items"`
+	Deletes []CRDTID   `json:"deletes"`
+}
+
+func (u CRDTUpdate) isEmpty() bool {
+	return len(u.Items) == 0 && len(u.Deletes) == 0
+}
+
+// crdtPeer is the latest seq a peer has acknowledged and when it was last
+// connected.
+type crdtPeer struct {
+	Seq  int       `json:"seq"`
+	Seen time.Time `json:"seen"`
+}
+
+// StateVector maps each client to the highest clock integrated from it.
+type StateVector map[string]int
+
+type CRDTDoc struct {
+	items          []*CRDTItem
+	byID           map[CRDTID]*CRDTItem
+	stateVector    StateVector
+	lamport        int
+	pending        []CRDTItem
+	pendingDeletes []CRDTID
+
+	// index caches the position of each item in items. An insert shifts the
+	// items after it, so positions from staleFrom on may be out of date and
+	// are checked before use.
+	index     map[CRDTID]int
+	staleFrom int
+
+	// seq counts batches of deletions, and compactedSeq is the latest of
+	// them whose tombstones have been compacted.
+	seq          int
+	compactedSeq int
+	deleting     bool
+	peers        map[string]crdtPeer
+}
+
+// crdtState is a document as persisted, including the items and deletes still
+// waiting for their dependencies.
+type crdtState struct {
+	Items          []CRDTItem          `json:"items"`
+	Seq            int                 `json:"seq,omitempty"`
+	CompactedSeq   int                 `json:"compactedSeq,omitempty"`
+	Peers          map[string]crdtPeer `json:"peers,omitempty"`
+	Pending        []CRDTItem          `json:"pending,omitempty"`
+	PendingDeletes []CRDTID            `json:"pendingDeletes,omitempty"`
+}
+
+func newCRDTDoc() *CRDTDoc {
+	return &CRDTDoc{
+		byID:        make(map[CRDTID]*CRDTItem),
+		stateVector: make(StateVector),
+		index:       make(map[CRDTID]int),
+		peers:       make(map[string]crdtPeer),
+	}
+}
+
+// loadCRDTDoc rebuilds a document from persisted state, falling back to
+// seeding it from content when there is no state yet, and reconciles it with
+// content in case the two have drifted apart.
+func loadCRDTDoc(state []byte, content string) *CRDTDoc {
+	doc := newCRDTDoc()
+	if len(state) > 0 {
+		var saved crdtState
+		if err := json.Unmarshal(state, &saved); err == nil {
+			doc.seq, doc.compactedSeq = saved.Seq, saved.CompactedSeq
+			for i := range saved.Items {
+				// When each tombstone was deleted isn't kept, so treat them
+				// all as deleted in the latest batch
+				saved.Items[i].deletedSeq = saved.Seq
+				doc.appendItem(saved.Items[i])
+			}
+			for peer, ack := range saved.Peers {
+				doc.peers[peer] = ack
+			}
+			doc.pending, doc.pendingDeletes = saved.Pending, saved.PendingDeletes
+		}
+	}
+	doc.ApplyText(content)
+	return doc
+}
+
+func (d *CRDTDoc) appendItem(item CRDTItem) {
+	it := item
+	d.index[it.ID] = len(d.items)
+	d.items = append(d.items, &it)
+	d.byID[it.ID] = &it
+	d.stateVector[it.ID.Client] = max(d.stateVector[it.ID.Client], it.ID.Clock)
+	d.lamport = max(d.lamport, it.Lamport)
+}
+
+func (d *CRDTDoc) Encode() []byte {
+	state := crdtState{
+		Items:          make([]CRDTItem, len(d.items)),
+		Seq:            d.seq,
+		CompactedSeq:   d.compactedSeq,
+		Peers:          d.peers,
+		Pending:        d.pending,
+		PendingDeletes: d.pendingDeletes,
+	}
+	for i, it := range d.items {
+		state.Items[i] = *it
+	}
+	data, _ := json.Marshal(state)
+	return data
+}
+
+func (d *CRDTDoc) String() string {
+	var buf []byte
+	for _, it := range d.items {
+		if !it.Deleted {
+			buf = append(buf, it.Content...)
+		}
+	}
+	return string(buf)
+}
+
+func (d *CRDTDoc) StateVector() StateVector {
+	sv := make(StateVector, len(d.stateVector))
+	for client, clock := range d.stateVector {
+		sv[client] = clock
+	}
+	return sv
+}
+
+// MissingUpdate returns everything a peer with state vector sv has not seen.
+// Items are ordered by Lamport time so every origin precedes its dependents.
+func (d *CRDTDoc) MissingUpdate(sv StateVector) CRDTUpdate {
+	update := CRDTUpdate{Items: []CRDTItem{}, Deletes: []CRDTID{}}
+	for _, it := range d.items {
+		if it.ID.Clock > sv[it.ID.Client] {
+			update.Items = append(update.Items, *it)
+		} else if it.Deleted {
+			update.Deletes = append(update.Deletes, it.ID)
+		}
+	}
+	sort.Slice(update.Items, func(i, j int) bool {
+		return update.Items[i].Lamport < update.Items[j].Lamport
+	})
+	return update
+}
+
+// Seq returns the number of batches of deletions applied so far.
+func (d *CRDTDoc) Seq() int {
+	return d.seq
+}
+
+// CompactedSeq returns the seq of the latest deletions compacted away. Peers
+// that have not seen it must take a snapshot.
+func (d *CRDTDoc) CompactedSeq() int {
+	return d.compactedSeq
+}
+
+// Ack records that peer, a CRDT client ID, is connected and has applied the
+// deletions up to seq. When too many peers are remembered, the one seen
+// longest ago is forgotten.
+func (d *CRDTDoc) Ack(peer string, seq int, now time.Time) {
+	if peer == "" || peer == serverCRDTClient || len(peer) > maxCRDTClientLength {
+		return
+	}
+	ack, known := d.peers[peer]
+	if !known && len(d.peers) >= maxCRDTPeers {
+		var oldest string
+		for id, p := range d.peers {
+			if oldest == "" || p.Seen.Before(d.peers[oldest].Seen) {
+				oldest = id
+			}
+		}
+		delete(d.peers, oldest)
+	}
+	d.peers[peer] = crdtPeer{Seq: max(ack.Seq, min(seq, d.seq)), Seen: now}
+}
+
+// AckedSeq returns the latest seq every remembered peer has acknowledged,
+// first forgetting peers not seen within crdtPeerExpiry of now.
+func (d *CRDTDoc) AckedSeq(now time.Time) int {
+	seq := d.seq
+	for peer, ack := range d.peers {
+		if now.Sub(ack.Seen) > crdtPeerExpiry {
+			delete(d.peers, peer)
+			continue
+		}
+		seq = min(seq, ack.Seq)
+	}
+	return seq
+}
+
+// Snapshot returns every item in document order, tombstones included. Unlike
+// MissingUpdate it is not merged: a peer replaces its document with the items
+// in this order and takes the doc's state vector as its own.
+func (d *CRDTDoc) Snapshot() CRDTUpdate {
+	update := CRDTUpdate{Items: make([]CRDTItem, len(d.items)), Deletes: []CRDTID{}}
+	for i, it := range d.items {
+		update.Items[i] = *it
+	}
+	return update
+}
+
+func (d *CRDTDoc) indexOf(id CRDTID) int {
+	if i, ok := d.index[id]; ok && i < len(d.items) && d.items[i].ID == id {
+		return i
+	}
+	for i := d.staleFrom; i < len(d.items); i++ {
+		d.index[d.items[i].ID] = i
+	}
+	d.staleFrom = len(d.items)
+	if i, ok := d.index[id]; ok {
+		return i
+	}
+	return -1
+}
+
+// validItem reports whether a remote item could have been made by a
+// well-behaved peer, leaving the Lamport checks to integrate.
+func (d *CRDTDoc) validItem(item CRDTItem) bool {
+	client := item.ID.Client
+	if client == "" || client == serverCRDTClient || len(client) > maxCRDTClientLength {
+		return false
+	}
+	if item.ID.Clock < 1 || item.ID.Clock > d.stateVector[client]+maxCRDTPending {
+		return false
+	}
+	return utf8.RuneCountInString(item.Content) == 1
+}
+
+// integrate inserts a remote item once its predecessor from the same client
+// and its origin are known. It reports whether the item was consumed, which
+// includes items that are dropped as invalid.
+func (d *CRDTDoc) integrate(item CRDTItem) (integrated bool, ready bool) {
+	if item.ID.Clock <= d.stateVector[item.ID.Client] {
+		return false, true
+	}
+	if item.ID.Clock != d.stateVector[item.ID.Client]+1 {
+		return false, false
+	}
+
+	// A peer's Lamport time is one more than the latest it has seen, and it
+	// has seen nothing the server hasn't, so anything later is forged and
+	// would let one item outrank every future insert
+	originLamport := 0
+	if item.Origin != nil {
+		origin, ok := d.byID[*item.Origin]
+		if !ok {
+			// An origin already integrated but gone was compacted, so the
+			// item can never be placed
+			if item.Origin.Clock <= d.stateVector[item.Origin.Client] {
+				log.Printf("Dropping CRDT item %s:%d after compacted origin %s:%d", item.ID.Client, item.ID.Clock, item.Origin.Client, item.Origin.Clock)
+				return false, true
+			}
+			return false, false
+		}
+		originLamport = origin.Lamport
+	}
+	if item.Lamport <= originLamport || item.Lamport > d.lamport+1 {
+		log.Printf("Dropping CRDT item %s:%d with Lamport time %d", item.ID.Client, item.ID.Clock, item.Lamport)
+		return false, true
+	}
+
+	pos := 0
+	if item.Origin != nil {
+		pos = d.indexOf(*item.Origin) + 1
+	}
+	// Concurrent inserts after the same origin are ordered by descending
+	// Lamport time, ties broken by client ID. Descendants of a skipped item
+	// always have a later Lamport time, so they are skipped with it.
+	for pos < len(d.items) {
+		next := d.items[pos]
+		if next.Lamport < item.Lamport || (next.Lamport == item.Lamport && next.ID.Client < item.ID.Client) {
+			break
+		}
+		pos++
+	}
+
+	it := item
+	if it.Deleted {
+		d.delete(&it)
+	}
+	d.items = append(d.items, nil)
+	copy(d.items[pos+1:], d.items[pos:])
+	d.items[pos] = &it
+	d.byID[it.ID] = &it
+	d.index[it.ID] = pos
+	d.staleFrom = min(d.staleFrom, pos+1)
+	d.stateVector[it.ID.Client] = it.ID.Clock
+	d.lamport = max(d.lamport, it.Lamport)
+	return true, true
+}
+
+// Apply merges a remote update and returns the part of it that was new to
+// this document, suitable for forwarding to other peers. Items whose
+// dependencies have not arrived yet are held back until they do.
+func (d *CRDTDoc) Apply(update CRDTUpdate) CRDTUpdate {
+	applied := CRDTUpdate{Items: []CRDTItem{}, Deletes: []CRDTID{}}
+
+	queue := d.pending
+	for _, item := range update.Items {
+		if d.validItem(item) {
+			queue = append(queue, item)
+		} else {
+			log.Printf("Dropping invalid CRDT item %s:%d", item.ID.Client, item.ID.Clock)
+		}
+	}
+	d.pending = nil
+	for progress := true; progress; {
+		progress = false
+		var waiting []CRDTItem
+		for _, item := range queue {
+			integrated, ready := d.integrate(item)
+			if integrated {
+				applied.Items = append(applied.Items, item)
+				progress = true
+			} else if !ready {
+				waiting = append(waiting, item)
+			}
+		}
+		queue = waiting
+	}
+	if len(queue) > maxCRDTPending {
+		log.Printf("Dropping %d CRDT items waiting for dependencies", len(queue)-maxCRDTPending)
+		queue = queue[:maxCRDTPending]
+	}
+	d.pending = queue
+
+	deletes := append(d.pendingDeletes, update.Deletes...)
+	d.pendingDeletes = nil
+	for _, id := range deletes {
+		it, ok := d.byID[id]
+		if !ok {
+			// Only items that have yet to arrive are worth waiting for;
+			// anything else never existed or was compacted
+			if id.Clock > d.stateVector[id.Client] && len(d.pendingDeletes) < maxCRDTPending {
+				d.pendingDeletes = append(d.pendingDeletes, id)
+			}
+			continue
+		}
+		if !it.Deleted {
+			d.delete(it)
+			applied.Deletes = append(applied.Deletes, id)
+		}
+	}
+	d.endDeletes()
+	return applied
+}
+
+// delete tombstones an item as part of the current batch of deletions, which
+// endDeletes closes.
+func (d *CRDTDoc) delete(it *CRDTItem) {
+	it.Deleted = true
+	it.deletedSeq = d.seq + 1
+	d.deleting = true
+}
+
+func (d *CRDTDoc) endDeletes() {
+	if d.deleting {
+		d.seq++
+		d.deleting = false
+	}
+}
+
+// Compact removes the tombstones of deletions up to seq, which every peer
+// that may still send updates has acknowledged, see AckedSeq. Tombstones that items held
+// back are waiting to be inserted after are kept.
+func (d *CRDTDoc) Compact(seq int) {
+	seq = min(seq, d.seq)
+	if seq <= d.compactedSeq {
+		return
+	}
+
+	needed := make(map[CRDTID]bool)
+	for _, item := range d.pending {
+		if item.Origin != nil {
+			needed[*item.Origin] = true
+		}
+	}
+
+	kept := d.items[:0]
+	removed := 0
+	for _, it := range d.items {
+		if it.Deleted && it.deletedSeq <= seq && !needed[it.ID] {
+			delete(d.byID, it.ID)
+			delete(d.index, it.ID)
+			d.compactedSeq = max(d.compactedSeq, it.deletedSeq)
+			removed++
+			continue
+		}
+		kept = append(kept, it)
+	}
+	if removed == 0 {
+		return
+	}
+	clear(d.items[len(kept):])
+	d.items = kept
+	d.staleFrom = 0
+}
+
+// ApplyText makes the document read content by deleting and inserting
+// around the common prefix and suffix, as edits from serverCRDTClient. It
+// returns the resulting update for CRDT peers.
+func (d *CRDTDoc) ApplyText(content string) CRDTUpdate {
+	update := CRDTUpdate{Items: []CRDTItem{}, Deletes: []CRDTID{}}
+
+	var visible []*CRDTItem
+	for _, it := range d.items {
+		if !it.Deleted {
+			visible = append(visible, it)
+		}
+	}
+	runes := []rune(content)
+
+	prefix := 0
+	for prefix < len(visible) && prefix < len(runes) && visible[prefix].Content == string(runes[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(visible)-prefix && suffix < len(runes)-prefix &&
+		visible[len(visible)-1-suffix].Content == string(runes[len(runes)-1-suffix]) {
+		suffix++
+	}
+
+	for _, it := range visible[prefix : len(visible)-suffix] {
+		d.delete(it)
+		update.Deletes = append(update.Deletes, it.ID)
+	}
+	d.endDeletes()
+
+	var origin *CRDTID
+	if prefix > 0 {
+		id := visible[prefix-1].ID
+		origin = &id
+	}
+	for _, r := range runes[prefix : len(runes)-suffix] {
+		d.lamport++
+		item := CRDTItem{
+			ID:      CRDTID{Client: serverCRDTClient, Clock: d.stateVector[serverCRDTClient] + 1},
+			Lamport: d.lamport,
+			Origin:  origin,
+			Content: string(r),
+		}
+		d.integrate(item)
+		update.Items = append(update.Items, item)
+		id := item.ID
+		origin = &id
+	}
+	return update
+}
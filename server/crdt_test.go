@@ -0,0 +1,307 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// replica loads a copy of doc, as a peer that has synced with it would hold.
+func replica(doc *CRDTDoc) *CRDTDoc {
+	return loadCRDTDoc(doc.Encode(), doc.String())
+}
+
+// localEdit makes a peer's edit to d: deleting count characters at pos and
+// inserting text there as client. It returns the update to send.
+func localEdit(d *CRDTDoc, client string, pos, count int, text string) CRDTUpdate {
+	update := CRDTUpdate{Items: []CRDTItem{}, Deletes: []CRDTID{}}
+
+	var visible []*CRDTItem
+	for _, it := range d.items {
+		if !it.Deleted {
+			visible = append(visible, it)
+		}
+	}
+	for _, it := range visible[pos : pos+count] {
+		d.delete(it)
+		update.Deletes = append(update.Deletes, it.ID)
+	}
+	d.endDeletes()
+
+	var origin *CRDTID
+	if pos > 0 {
+		id := visible[pos-1].ID
+		origin = &id
+	}
+	for _, r := range text {
+		item := CRDTItem{
+			ID:      CRDTID{Client: client, Clock: d.stateVector[client] + 1},
+			Lamport: d.lamport + 1,
+			Origin:  origin,
+			Content: string(r),
+		}
+		d.integrate(item)
+		update.Items = append(update.Items, item)
+		id := item.ID
+		origin = &id
+	}
+	return update
+}
+
+func TestCRDTConcurrentEditsConverge(t *testing.T) {
+	type edit struct {
+		pos, count int
+		text       string
+	}
+	tests := []struct {
+		name string
+		base string
+		a, b edit
+	}{
+		{"insert same place", "ab", edit{1, 0, "x"}, edit{1, 0, "y"}},
+		{"insert runs same place", "ab", edit{1, 0, "xyz"}, edit{1, 0, "12"}},
+		{"insert at start", "ab", edit{0, 0, "x"}, edit{0, 0, "y"}},
+		{"insert at end", "ab", edit{2, 0, "x"}, edit{2, 0, "y"}},
+		{"insert into empty", "", edit{0, 0, "abc"}, edit{0, 0, "xyz"}},
+		{"insert where other deletes", "abcd", edit{2, 0, "x"}, edit{1, 2, ""}},
+		{"overlapping deletes", "abcdef", edit{1, 3, ""}, edit{2, 3, "y"}},
+		{"astral runes", "😀😀", edit{1, 0, "😎"}, edit{1, 1, "é"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := newCRDTDoc()
+			base.ApplyText(tt.base)
+
+			a, b := replica(base), replica(base)
+			updateA := localEdit(a, "a", tt.a.pos, tt.a.count, tt.a.text)
+			updateB := localEdit(b, "b", tt.b.pos, tt.b.count, tt.b.text)
+
+			first, second := replica(base), replica(base)
+			first.Apply(updateA)
+			first.Apply(updateB)
+			second.Apply(updateB)
+			second.Apply(updateA)
+			a.Apply(updateB)
+			b.Apply(updateA)
+
+			want := first.String()
+			for name, doc := range map[string]*CRDTDoc{"second": second, "a": a, "b": b} {
+				if got := doc.String(); got != want {
+					t.Errorf("%s has %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCRDTRandomEditsConverge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	server := newCRDTDoc()
+	server.ApplyText("the quick brown fox")
+	peers := map[string]*CRDTDoc{"a": replica(server), "b": replica(server), "c": replica(server)}
+
+	for round := 0; round < 200; round++ {
+		// Each peer edits concurrently, then the server applies the updates
+		// in a random order and relays them, shuffled, to the others
+		updates := make(map[string]CRDTUpdate)
+		for name, peer := range peers {
+			length := len([]rune(peer.String()))
+			pos := rng.Intn(length + 1)
+			count := rng.Intn(min(3, length-pos) + 1)
+			text := string(rune('a' + rng.Intn(26)))
+			updates[name] = localEdit(peer, name, pos, count, text)
+		}
+		for _, name := range []string{"c", "a", "b"} {
+			update := server.Apply(updates[name])
+			rng.Shuffle(len(update.Items), func(i, j int) {
+				update.Items[i], update.Items[j] = update.Items[j], update.Items[i]
+			})
+			for other, peer := range peers {
+				if other != name {
+					peer.Apply(update)
+				}
+			}
+		}
+		if round%20 == 0 {
+			server.Compact(server.Seq())
+		}
+	}
+
+	want := server.String()
+	for name, peer := range peers {
+		if got := peer.String(); got != want {
+			t.Errorf("peer %s has %q, want %q", name, got, want)
+		}
+	}
+	if fresh := replica(server); fresh.String() != want {
+		t.Errorf("reloaded doc has %q, want %q", fresh.String(), want)
+	}
+}
+
+func TestCRDTRejectsInvalidItems(t *testing.T) {
+	doc := newCRDTDoc()
+	doc.ApplyText("ab")
+	origin := doc.items[1].ID
+
+	tests := []struct {
+		name string
+		item CRDTItem
+	}{
+		{"server client", CRDTItem{ID: CRDTID{serverCRDTClient, 3}, Lamport: 3, Origin: &origin, Content: "x"}},
+		{"zero clock", CRDTItem{ID: CRDTID{"a", 0}, Lamport: 3, Origin: &origin, Content: "x"}},
+		{"clock too far ahead", CRDTItem{ID: CRDTID{"a", maxCRDTPending + 1}, Lamport: 3, Origin: &origin, Content: "x"}},
+		{"lamport from the future", CRDTItem{ID: CRDTID{"a", 1}, Lamport: 1 << 40, Origin: &origin, Content: "x"}},
+		{"lamport before origin", CRDTItem{ID: CRDTID{"a", 1}, Lamport: 2, Origin: &origin, Content: "x"}},
+		{"empty content", CRDTItem{ID: CRDTID{"a", 1}, Lamport: 3, Origin: &origin, Content: ""}},
+		{"several runes", CRDTItem{ID: CRDTID{"a", 1}, Lamport: 3, Origin: &origin, Content: "xy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied := doc.Apply(CRDTUpdate{Items: []CRDTItem{tt.item}})
+			if !applied.isEmpty() || doc.String() != "ab" || len(doc.pending) != 0 {
+				t.Errorf("item was accepted: applied %v, content %q, %d pending", applied, doc.String(), len(doc.pending))
+			}
+		})
+	}
+}
+
+func TestCRDTCompact(t *testing.T) {
+	doc := newCRDTDoc()
+	doc.ApplyText("abcd")
+	peer := replica(doc)
+	doc.ApplyText("ad")
+	if doc.Seq() != 1 {
+		t.Fatalf("seq is %d after one batch of deletions", doc.Seq())
+	}
+
+	// The peer hasn't seen b and c deleted and inserts after c
+	doc.Compact(0)
+	doc.Apply(localEdit(peer, "p", 3, 0, "xy"))
+	if got := doc.String(); got != "axyd" {
+		t.Fatalf("content is %q, want %q", got, "axyd")
+	}
+
+	doc.Compact(1)
+	if len(doc.items) != 4 || doc.CompactedSeq() != 1 {
+		t.Fatalf("got %d items and compacted seq %d after compacting b and c", len(doc.items), doc.CompactedSeq())
+	}
+
+	// An insert after x that arrives before its predecessor keeps x's
+	// tombstone until it can be placed
+	doc.ApplyText("ayd")
+	first := localEdit(peer, "p", 0, 0, "q")
+	second := localEdit(peer, "p", 5, 0, "z")
+	doc.Apply(second)
+	doc.Compact(2)
+	if len(doc.items) != 4 || doc.CompactedSeq() != 1 {
+		t.Fatalf("got %d items and compacted seq %d, want x kept", len(doc.items), doc.CompactedSeq())
+	}
+	doc.Apply(first)
+	if got := doc.String(); got != "qazyd" {
+		t.Fatalf("content is %q, want %q", got, "qazyd")
+	}
+	doc.Compact(2)
+	if len(doc.items) != 5 || doc.CompactedSeq() != 2 {
+		t.Errorf("got %d items and compacted seq %d after compacting x", len(doc.items), doc.CompactedSeq())
+	}
+
+	loaded := replica(doc)
+	if loaded.Seq() != doc.Seq() || loaded.CompactedSeq() != doc.CompactedSeq() || loaded.String() != "qazyd" {
+		t.Errorf("reloaded doc has seq %d, compacted seq %d and content %q", loaded.Seq(), loaded.CompactedSeq(), loaded.String())
+	}
+}
+
+func TestCRDTKeepsTombstonesForOfflinePeers(t *testing.T) {
+	now := time.Now()
+	doc := newCRDTDoc()
+	doc.ApplyText("abcd")
+	peer := replica(doc)
+	doc.Ack("p", doc.Seq(), now)
+
+	// b and c are deleted while the peer is offline, and the room flushes
+	doc.ApplyText("ad")
+	doc = replica(doc)
+	doc.Compact(doc.AckedSeq(now))
+	if doc.CompactedSeq() != 0 {
+		t.Fatalf("compacted up to seq %d with the peer's deletions unacknowledged", doc.CompactedSeq())
+	}
+
+	// The peer's offline insert after c still finds its place
+	doc.Apply(localEdit(peer, "p", 3, 0, "xy"))
+	if got := doc.String(); got != "axyd" {
+		t.Fatalf("content is %q, want %q", got, "axyd")
+	}
+
+	doc.Ack("p", doc.Seq(), now.Add(time.Hour))
+	doc.Compact(doc.AckedSeq(now.Add(time.Hour)))
+	if doc.CompactedSeq() != 1 {
+		t.Errorf("compacted seq is %d once the peer acknowledged the deletions", doc.CompactedSeq())
+	}
+}
+
+func TestCRDTForgetsExpiredPeers(t *testing.T) {
+	now := time.Now()
+	doc := newCRDTDoc()
+	doc.ApplyText("abc")
+	doc.Ack("old", 0, now)
+	doc.ApplyText("a")
+	doc.Ack("recent", doc.Seq(), now.Add(crdtPeerExpiry))
+
+	if seq := doc.AckedSeq(now.Add(crdtPeerExpiry)); seq != 0 {
+		t.Errorf("acked seq is %d with both peers behind", seq)
+	}
+	if seq := doc.AckedSeq(now.Add(crdtPeerExpiry + time.Minute)); seq != doc.Seq() {
+		t.Errorf("acked seq is %d, want %d once the old peer expired", seq, doc.Seq())
+	}
+	if seq := doc.AckedSeq(now.Add(2*crdtPeerExpiry + time.Minute)); seq != doc.Seq() {
+		t.Errorf("acked seq is %d, want %d with every peer expired", seq, doc.Seq())
+	}
+	if len(doc.peers) != 0 {
+		t.Errorf("%d peers still remembered", len(doc.peers))
+	}
+
+	// Invalid client IDs aren't remembered
+	doc.Ack("", 0, now)
+	doc.Ack(serverCRDTClient, 0, now)
+	if len(doc.peers) != 0 {
+		t.Errorf("remembered %v", doc.peers)
+	}
+}
+
+func TestCRDTDropsItemsAfterCompactedOrigins(t *testing.T) {
+	doc := newCRDTDoc()
+	doc.ApplyText("abc")
+	peer := replica(doc)
+	doc.ApplyText("ac")
+	doc.Compact(doc.Seq())
+
+	// The peer never saw b deleted and was forgotten
+	doc.Apply(localEdit(peer, "p", 2, 0, "x"))
+	if got := doc.String(); got != "ac" || len(doc.pending) != 0 {
+		t.Errorf("content is %q with %d items pending, want the insert dropped", got, len(doc.pending))
+	}
+}
+
+func TestCRDTPersistsPending(t *testing.T) {
+	now := time.Now()
+	doc := newCRDTDoc()
+	doc.ApplyText("ab")
+	peer := replica(doc)
+	doc.Ack("p", 0, now)
+
+	first := localEdit(peer, "p", 1, 0, "x")
+	second := localEdit(peer, "p", 2, 1, "y")
+	doc.Apply(second)
+	if len(doc.pending) != 1 || len(doc.pendingDeletes) != 0 {
+		t.Fatalf("got %d items and %d deletes pending", len(doc.pending), len(doc.pendingDeletes))
+	}
+
+	loaded := replica(doc)
+	if len(loaded.pending) != 1 || loaded.peers["p"].Seq != 0 || !loaded.peers["p"].Seen.Equal(now) {
+		t.Fatalf("reloaded doc has %d items pending and peers %v", len(loaded.pending), loaded.peers)
+	}
+	loaded.Apply(first)
+	if got := loaded.String(); got != "axy" {
+		t.Errorf("content is %q, want %q", got, "axy")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type DiffLineOp string
+
+const (
+	DiffContext DiffLineOp = "context"
+	DiffAdd     DiffLineOp = "add"
+	DiffDelete  DiffLineOp = "delete"
+)
+
+// Lines of unchanged context kept around each hunk, as in diff -u.
+const diffContextLines = 3
+
+type DiffLine struct {
+	Op   DiffLineOp `json:"op"`
+	Text string     `json:"text"`
+	// NoNewline marks the last line of a document that doesn't end in a
+	// newline.
+	NoNewline bool `json:"noNewline,omitempty"`
+}
+
+type DiffHunk struct {
+	OldStart int        `json:"oldStart"`
+	OldLines int        `json:"oldLines"`
+	NewStart int        `json:"newStart"`
+	NewLines int        `json:"newLines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// Limits on the work one diff may take. Memory grows with the square of the
+// number of edits, and time with edits times lines.
+const (
+	maxDiffLines = 50000
+	maxDiffEdits = 2000
+)
+
+var errDiffTooLarge = errors.New("revisions differ too much to diff")
+
+// splitLines splits content into lines that keep their newline, so that a
+// missing newline at the end counts as a change to the last line.
+func splitLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func newDiffLine(op DiffLineOp, line string) DiffLine {
+	text, ok := strings.CutSuffix(line, "\n")
+	return DiffLine{Op: op, Text: text, NoNewline: !ok}
+}
+
+// diffLines computes a shortest edit script from a to b with Myers'
+// algorithm and returns it as a sequence of context, add and delete lines.
+// It gives up with errDiffTooLarge past maxDiffLines or maxDiffEdits.
+func diffLines(a, b []string) ([]DiffLine, error) {
+	n, m := len(a), len(b)
+	if n > maxDiffLines || m > maxDiffLines {
+		return nil, errDiffTooLarge
+	}
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] holds diagonals -d..d of v as they were before step d, which
+	// is all the walk back needs from that step.
+	var trace [][]int
+
+search:
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			return nil, errDiffTooLarge
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk the trace backwards from the end to recover the edits.
+	var reversed []DiffLine
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v[d+prevK]
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, newDiffLine(DiffContext, a[x]))
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, newDiffLine(DiffAdd, b[y]))
+		} else {
+			x--
+			reversed = append(reversed, newDiffLine(DiffDelete, a[x]))
+		}
+	}
+
+	lines := make([]DiffLine, len(reversed))
+	for i, line := range reversed {
+		lines[len(reversed)-1-i] = line
+	}
+	return lines, nil
+}
+
+// buildHunks groups changed lines with up to context unchanged lines on
+// either side, merging hunks whose context would overlap.
+func buildHunks(lines []DiffLine, context int) []DiffHunk {
+	var hunks []DiffHunk
+	oldLine, newLine := 1, 1
+	i := 0
+	for i < len(lines) {
+		if lines[i].Op == DiffContext {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		start := max(0, i-context)
+		hunk := DiffHunk{
+			OldStart: oldLine - (i - start),
+			NewStart: newLine - (i - start),
+		}
+		end := i
+		for j := i; j < len(lines); j++ {
+			if lines[j].Op != DiffContext {
+				end = j
+			} else if j-end > 2*context {
+				break
+			}
+		}
+		end = min(len(lines), end+context+1)
+
+		for _, line := range lines[start:end] {
+			hunk.Lines = append(hunk.Lines, line)
+			if line.Op != DiffAdd {
+				hunk.OldLines++
+			}
+			if line.Op != DiffDelete {
+				hunk.NewLines++
+			}
+		}
+		for _, line := range lines[i:end] {
+			if line.Op != DiffAdd {
+				oldLine++
+			}
+			if line.Op != DiffDelete {
+				newLine++
+			}
+		}
+		// diff -u numbers an empty side by the line before it.
+		if hunk.OldLines == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStart--
+		}
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+func formatUnifiedDiff(fromName, toName string, hunks []DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", hunk.OldStart, hunk.OldLines, hunk.NewStart, hunk.NewLines)
+		for _, line := range hunk.Lines {
+			switch line.Op {
+			case DiffAdd:
+				sb.WriteByte('+')
+			case DiffDelete:
+				sb.WriteByte('-')
+			default:
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(line.Text)
+			sb.WriteByte('\n')
+			if line.NoNewline {
+				sb.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// applyHunks rebuilds the new document from the old one and the hunks
+// between them.
+func applyHunks(t *testing.T, old string, hunks []DiffHunk) string {
+	t.Helper()
+	oldLines := splitLines(old)
+	var out strings.Builder
+	next := 0
+	for _, hunk := range hunks {
+		start := hunk.OldStart - 1
+		if hunk.OldLines == 0 {
+			start = hunk.OldStart
+		}
+		for ; next < start; next++ {
+			out.WriteString(oldLines[next])
+		}
+		for _, line := range hunk.Lines {
+			if line.Op != DiffAdd {
+				if got := strings.TrimSuffix(oldLines[next], "\n"); got != line.Text {
+					t.Fatalf("hunk expects old line %d to be %q, got %q", next+1, line.Text, got)
+				}
+				next++
+			}
+			if line.Op != DiffDelete {
+				out.WriteString(line.Text)
+				if !line.NoNewline {
+					out.WriteByte('\n')
+				}
+			}
+		}
+	}
+	for ; next < len(oldLines); next++ {
+		out.WriteString(oldLines[next])
+	}
+	return out.String()
+}
+
+func TestDiffRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"identical", "a\nb\nc\n", "a\nb\nc\n"},
+		{"from empty", "", "a\nb\n"},
+		{"to empty", "a\nb\n", ""},
+		{"insert middle", "a\nb\nc\n", "a\nb\nx\nc\n"},
+		{"delete middle", "a\nb\nc\n", "a\nc\n"},
+		{"replace", "a\nb\nc\n", "a\nx\nc\n"},
+		{"add final newline", "a\nb", "a\nb\n"},
+		{"remove final newline", "a\nb\n", "a\nb"},
+		{"change without final newline", "a\nb", "a\nc"},
+		{"far apart", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n"},
+		{"unrelated", "a\nb\nc\n", "x\ny\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := diffLines(splitLines(tt.old), splitLines(tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hunks := buildHunks(lines, diffContextLines)
+			if (tt.old == tt.new) != (len(hunks) == 0) {
+				t.Fatalf("got %d hunks for old == new: %v", len(hunks), tt.old == tt.new)
+			}
+			if got := applyHunks(t, tt.old, hunks); got != tt.new {
+				t.Errorf("applying hunks gave %q, want %q", got, tt.new)
+			}
+		})
+	}
+}
+
+func TestDiffFinalNewlineUnified(t *testing.T) {
+	lines, err := diffLines(splitLines("a\n"), splitLines("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := formatUnifiedDiff("old", "new", buildHunks(lines, diffContextLines))
+	want := "--- old\n+++ new\n@@ -1,1 +1,1 @@\n-a\n+a\n\\ No newline at end of file\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	var a, b []string
+	for i := 0; i <= maxDiffEdits; i++ {
+		a = append(a, "a\n")
+		b = append(b, "b\n")
+	}
+	if _, err := diffLines(a, b); !errors.Is(err, errDiffTooLarge) {
+		t.Errorf("got %v, want errDiffTooLarge", err)
+	}
+	if _, err := diffLines(make([]string, maxDiffLines+1), nil); !errors.Is(err, errDiffTooLarge) {
+		t.Errorf("got %v for too many lines, want errDiffTooLarge", err)
+	}
+}
@@ -1,42 +1,68 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type MessageType string
 
 const (
-	TextUpdate     MessageType = "text-update"
-	InitialContent MessageType = "initial-content"
-	JoinRoom       MessageType = "join-room"
-	Ping           MessageType = "ping"
-	Pong           MessageType = "pong"
-	CommentAdd     MessageType = "comment-add"
-	CommentUpdate  MessageType = "comment-update"
-	CommentDelete  MessageType = "comment-delete"
-	CommentsSync   MessageType = "comments-sync"
-	UserJoined     MessageType = "user-joined"
-	UserLeft       MessageType = "user-left"
-	UserActivity   MessageType = "user-activity"
-	UsersSync      MessageType = "users-sync"
-	MediaUpload    MessageType = "media-upload"
-	MediaDelete    MessageType = "media-delete"
-	MediaSync      MessageType = "media-sync"
+	TextUpdate       MessageType = "text-update"
+	TextOps          MessageType = "text-ops"
+	TextOpsAck       MessageType = "text-ops-ack"
+	CRDTUpdateType   MessageType = "crdt-update"
+	CRDTSync         MessageType = "crdt-sync"
+	RestoreRevision  MessageType = "restore-revision"
+	RevisionRestored MessageType = "revision-restored"
+	InitialContent   MessageType = "initial-content"
+	JoinRoom         MessageType = "join-room"
+	Ping             MessageType = "ping"
+	Pong             MessageType = "pong"
+	CommentAdd       MessageType = "comment-add"
+	CommentUpdate    MessageType = "comment-update"
+	CommentDelete    MessageType = "comment-delete"
+	CommentReply     MessageType = "comment-reply"
+	CommentResolve   MessageType = "comment-resolve"
+	CommentReopen    MessageType = "comment-reopen"
+	CommentReact     MessageType = "comment-react"
+	MemberRoleType   MessageType = "member-role"
+	ErrorType        MessageType = "error"
+	ChatMessageType  MessageType = "chat-message"
+	ChatSync         MessageType = "chat-sync"
+	MentionType      MessageType = "mention"
+	MentionInbox     MessageType = "mention-inbox"
+	MentionsRead     MessageType = "mentions-read"
+	CommentsSync     MessageType = "comments-sync"
+	UserJoined       MessageType = "user-joined"
+	UserLeft         MessageType = "user-left"
+	UserActivity     MessageType = "user-activity"
+	UsersSync        MessageType = "users-sync"
+	UserToken        MessageType = "user-token"
+	MediaUpload      MessageType = "media-upload"
+	MediaDelete      MessageType = "media-delete"
+	MediaUpdate      MessageType = "media-update"
+	MediaSync        MessageType = "media-sync"
 )
 
 type BaseMessage struct {
@@ -49,14 +75,67 @@ type TextUpdateMessage struct {
 	Content string `json:"content"`
 }
 
+type TextOpsMessage struct {
+	BaseMessage
+	// Revision counts the edits applied to the live room, which OT clients
+	// base their ops on. It is not a history revision number.
+	Revision int      `json:"revision"`
+	Ops      []TextOp `json:"ops"`
+	UserID   string   `json:"userId,omitempty"`
+}
+
+type TextOpsAckMessage struct {
+	BaseMessage
+	Revision int `json:"revision"`
+}
+
 type InitialContentMessage struct {
 	BaseMessage
-	Content string `json:"content"`
+	Content  string `json:"content"`
+	Revision int    `json:"revision"`
+}
+
+type CRDTUpdateMessage struct {
+	BaseMessage
+	Update CRDTUpdate `json:"update"`
+	// Seq is the document's seq when sent by the server. When sent by a
+	// client it is the latest seq the client has applied, which acknowledges
+	// the deletions up to it.
+	Seq int `json:"seq,omitempty"`
+}
+
+type CRDTSyncMessage struct {
+	BaseMessage
+	Update      CRDTUpdate  `json:"update"`
+	StateVector StateVector `json:"stateVector"`
+	Revision    int         `json:"revision"`
+	Seq         int         `json:"seq"`
+	// Reset means Update is a snapshot to replace the client's document with
+	// rather than merge into it.
+	Reset bool `json:"reset,omitempty"`
 }
 
 type JoinRoomMessage struct {
 	BaseMessage
-	User User `json:"user"`
+	User        User `json:"user"`
+	SupportsOps bool `json:"supportsOps"`
+	// Token is the one issued for User.ID, see tokens.go.
+	Token string `json:"token,omitempty"`
+	// StateVector is sent by CRDT clients, which then receive only the
+	// updates they are missing instead of the full content.
+	StateVector StateVector `json:"stateVector,omitempty"`
+	// Seq is the latest CRDT seq the client has applied.
+	Seq int `json:"seq,omitempty"`
+	// CRDTClient is the client ID the peer creates CRDT items under. The
+	// document then keeps the tombstones the peer hasn't seen while it is
+	// offline, see crdt.go.
+	CRDTClient string `json:"crdtClient,omitempty"`
+	// Update holds the CRDT edits the client made while disconnected. They
+	// are merged before the crdt-sync, which would otherwise discard them if
+	// it is a reset.
+	Update *CRDTUpdate `json:"update,omitempty"`
+	// HideResolved leaves resolved threads out of the initial comments-sync.
+	HideResolved bool `json:"hideResolved"`
 }
 
 type PingMessage struct {
@@ -68,13 +147,51 @@ type PongMessage struct {
 }
 
 type Comment struct {
-	ID         string    `json:"id"`
-	LineNumber *int      `json:"lineNumber"`
-	LineRange  *string   `json:"lineRange"`
-	Author     string    `json:"author"`
-	AuthorID   string    `json:"authorId"`
-	Content    string    `json:"content"`
-	Timestamp  time.Time `json:"timestamp"`
+	ID         string     `json:"id"`
+	LineNumber *int       `json:"lineNumber"`
+	LineRange  *string    `json:"lineRange"`
+	Author     string     `json:"author"`
+	AuthorID   string     `json:"authorId"`
+	Content    string     `json:"content"`
+	Timestamp  time.Time  `json:"timestamp"`
+	EditedAt   *time.Time `json:"editedAt"`
+	ParentID   *string    `json:"parentId"`
+	Resolved   bool       `json:"resolved"`
+	ResolvedBy *string    `json:"resolvedBy"`
+	ResolvedAt *time.Time `json:"resolvedAt"`
+	// Outdated is set when the text the comment was anchored to is deleted.
+	Outdated bool `json:"outdated"`
+	// Deleted comments are kept as tombstones without content while they
+	// still have replies.
+	Deleted   bool              `json:"deleted"`
+	DeletedBy *string           `json:"deletedBy"`
+	DeletedAt *time.Time        `json:"deletedAt"`
+	Reactions []CommentReaction `json:"reactions"`
+}
+
+// CommentReaction aggregates everyone who reacted to a comment with Emoji.
+type CommentReaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"userIds"`
+}
+
+// CommentReactMessage adds or, with Remove set, takes back the sender's
+// reaction. The broadcast carries the comment's updated Reactions.
+type CommentReactMessage struct {
+	BaseMessage
+	CommentID string            `json:"commentId"`
+	Emoji     string            `json:"emoji"`
+	Remove    bool              `json:"remove"`
+	UserID    string            `json:"userId"`
+	Reactions []CommentReaction `json:"reactions"`
+}
+
+// CommentVersion is an earlier text of an edited comment.
+type CommentVersion struct {
+	Version   int       `json:"version"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type CommentMessage struct {
@@ -82,18 +199,59 @@ type CommentMessage struct {
 	Comment Comment `json:"comment"`
 }
 
+// CommentsMessage is sent as comments-sync. Clients may also send a
+// comments-sync to fetch the comments again, setting HideResolved to leave
+// out resolved threads.
 type CommentsMessage struct {
 	BaseMessage
-	Comments []Comment `json:"comments"`
+	Comments     []Comment `json:"comments"`
+	HideResolved bool      `json:"hideResolved,omitempty"`
 }
 
 type User struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Color       string    `json:"color"`
-	LastSeen    time.Time `json:"lastSeen"`
-	IsTyping    bool      `json:"isTyping"`
-	CurrentLine *int      `json:"currentLine"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Color       string     `json:"color"`
+	LastSeen    time.Time  `json:"lastSeen"`
+	IsTyping    bool       `json:"isTyping"`
+	CurrentLine *int       `json:"currentLine"`
+	Role        MemberRole `json:"role,omitempty"`
+	// Selections are kept at the room's current revision as others edit.
+	Selections []SelectionRange `json:"selections,omitempty"`
+}
+
+// MemberRoleMessage is sent by a room owner to change a member's role and
+// broadcast to the room once it has changed.
+type MemberRoleMessage struct {
+	BaseMessage
+	UserID string     `json:"userId"`
+	Role   MemberRole `json:"role"`
+}
+
+// ErrorMessage tells a client why a request was refused.
+type ErrorMessage struct {
+	BaseMessage
+	Request MessageType `json:"request"`
+	Message string      `json:"message"`
+}
+
+// MentionMessage tells a user they were @-mentioned in a comment.
+type MentionMessage struct {
+	BaseMessage
+	Mention Mention `json:"mention"`
+}
+
+// MentionInboxMessage lists a user's unread mentions across all rooms. It is
+// sent on join and again whenever mentions are marked read.
+type MentionInboxMessage struct {
+	BaseMessage
+	Mentions []Mention `json:"mentions"`
+}
+
+// MentionsReadMessage marks mentions read; an empty IDs marks all of them.
+type MentionsReadMessage struct {
+	BaseMessage
+	IDs []string `json:"ids"`
 }
 
 type UserMessage struct {
@@ -106,11 +264,17 @@ type UsersMessage struct {
 	Users []User `json:"users"`
 }
 
+// UserActivityMessage reports a user's typing state and cursor. Selections
+// are relative to Revision; a missing Revision means the current one and
+// missing Selections leave the previous ones in place. The server always
+// broadcasts the user's full set of selections at the current revision.
 type UserActivityMessage struct {
 	BaseMessage
-	UserID      string `json:"userId"`
-	IsTyping    bool   `json:"isTyping"`
-	CurrentLine *int   `json:"currentLine"`
+	UserID      string           `json:"userId"`
+	IsTyping    bool             `json:"isTyping"`
+	CurrentLine *int             `json:"currentLine"`
+	Selections  []SelectionRange `json:"selections"`
+	Revision    *int             `json:"revision,omitempty"`
 }
 
 type MediaFile struct {
@@ -121,6 +285,13 @@ type MediaFile struct {
 	URL        string    `json:"url"`
 	UploadedAt time.Time `json:"uploadedAt"`
 	UploadedBy string    `json:"uploadedBy"`
+	// BlobHash names the stored file, see blobs.go. It is empty for files
+	// kept in the room directory by older versions.
+	BlobHash string `json:"-"`
+	// Set for images once the thumbnail worker has processed them.
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
 }
 
 type MediaMessage struct {
@@ -133,41 +304,93 @@ type MediaSyncMessage struct {
 	MediaFiles []MediaFile `json:"mediaFiles"`
 }
 
-type Client struct {
-	Conn     *websocket.Conn
-	User     User
-	LastPing time.Time
+// RoomRevision is a saved snapshot in a room's history. Its Number counts the
+// snapshots saved for the room. It is unrelated to Room.Revision, the
+// revision in text-ops, initial-content and crdt-sync messages, which counts
+// the edits the live room has applied and is never stored. Timestamp is when
+// the snapshot was created and UpdatedAt when it last took in a coalesced
+// edit.
+type RoomRevision struct {
+	Number    int       `json:"number"`
+	AuthorID  string    `json:"authorId"`
+	Timestamp time.Time `json:"timestamp"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Size      int       `json:"size"`
+	Content   string    `json:"content,omitempty"`
+}
+
+type RoomDiff struct {
+	From    int        `json:"from"`
+	To      int        `json:"to"`
+	Unified string     `json:"unified"`
+	Hunks   []DiffHunk `json:"hunks"`
+}
+
+type RestoreRevisionMessage struct {
+	BaseMessage
+	Number int `json:"number"`
+}
+
+type RevisionRestoredMessage struct {
+	BaseMessage
+	Number    int    `json:"number"`
+	NewNumber int    `json:"newNumber"`
+	UserID    string `json:"userId"`
 }
 
-type Room struct {
-	Content    string
-	Clients    map[string]*Client
-	Comments   []Comment
-	MediaFiles []MediaFile
-	mutex      sync.RWMutex
-	CreatedAt  time.Time
+// RestoreRequest asks for a revision to be restored. The restore is recorded
+// as UserID's only with that user's token in an Authorization: Bearer header,
+// and as anonymous when UserID is empty.
+type RestoreRequest struct {
+	Number int    `json:"number"`
+	UserID string `json:"userId"`
 }
 
 var (
-	rooms      = make(map[string]*Room)
-	roomsMutex sync.RWMutex
-	upgrader   = websocket.Upgrader{
+	rooms    = newRoomRegistry()
+	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 	}
-	db       *sql.DB
+	store    Store
 	filesDir string
 )
 
+// Edits by the same author within this window of the latest revision's last
+// update extend it instead of starting a new one, so history isn't one entry
+// per keystroke.
+const revisionCoalesceWindow = 30 * time.Second
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: Could not load .env file: %v", err)
 	}
 
+	var err error
+	store, err = openStore()
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer store.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
+	// Bring the schema up to date before serving anything
+	applied, err := store.MigrateUp()
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+	if err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
 	// Get files directory from environment
 	filesDir = os.Getenv("FILES_DIR")
 	if filesDir == "" {
@@ -179,68 +402,45 @@ func main() {
 		log.Fatal("Failed to create files directory:", err)
 	}
 
-	var err error
-	db, err = sql.Open("sqlite3", "./rooms.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+	// Uploads interrupted by a restart are never finished
+	os.RemoveAll(filepath.Join(filesDir, ".incoming"))
 
-	// Create tables
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS rooms (
-		code TEXT PRIMARY KEY,
-		content TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	)`)
-	if err != nil {
+	if maxUploadSize, err = envBytes("MAX_UPLOAD_SIZE", maxUploadSize); err != nil {
 		log.Fatal(err)
 	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS comments (
-		id TEXT PRIMARY KEY,
-		room_code TEXT,
-		line_number INTEGER,
-		line_range TEXT,
-		author TEXT,
-		author_id TEXT,
-		content TEXT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY(room_code) REFERENCES rooms(code)
-	)`)
-	if err != nil {
+	if roomUploadQuota, err = envBytes("ROOM_UPLOAD_QUOTA", roomUploadQuota); err != nil {
 		log.Fatal(err)
 	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS media_files (
-		id TEXT PRIMARY KEY,
-		room_code TEXT,
-		name TEXT,
-		type TEXT,
-		size INTEGER,
-		url TEXT,
-		uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		uploaded_by TEXT,
-		FOREIGN KEY(room_code) REFERENCES rooms(code)
-	)`)
-	if err != nil {
-		log.Fatal(err)
+	if types := os.Getenv("UPLOAD_ALLOWED_TYPES"); types != "" {
+		allowedUploadTypes = parseUploadTypes(types)
 	}
 
 	go startRoomCleanup()
-	go startPingChecker()
+	go startThumbnailWorker()
+
+	httpMux := http.NewServeMux()
+	httpMux.HandleFunc("/o/upload", corsMiddleware(handleFileUpload))
+	httpMux.HandleFunc("/o/files/", corsMiddleware(handleFileServe))
+	httpMux.HandleFunc("/o/files/{code}/{id}/thumbnail", corsMiddleware(handleThumbnailServe))
+	httpMux.HandleFunc("/o/delete/", corsMiddleware(handleFileDelete))
+	httpMux.HandleFunc("/o/purge/", corsMiddleware(handleRoomPurge))
+	httpMux.HandleFunc("/o/rooms/{code}/history", corsMiddleware(handleRoomHistory))
+	httpMux.HandleFunc("/o/rooms/{code}/revisions/{n}", corsMiddleware(handleRoomRevision))
+	httpMux.HandleFunc("/o/rooms/{code}/restore", corsMiddleware(handleRoomRestore))
+	httpMux.HandleFunc("/o/rooms/{code}/diff", corsMiddleware(handleRoomDiff))
+	httpMux.HandleFunc("/o/rooms/{code}/comments/{id}/versions", corsMiddleware(handleCommentVersions))
+	httpMux.HandleFunc("/o/search", corsMiddleware(handleSearch))
+	httpMux.HandleFunc("/o/tus/{$}", tusMiddleware(handleTusCreate))
+	httpMux.HandleFunc("/o/tus/{id}", tusMiddleware(handleTusUpload))
+	httpMux.Handle("/o/metrics", expvar.Handler())
+
+	http_port := 8090
+	httpServer := &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", http_port), Handler: httpMux}
 
 	// Start HTTP server for file operations in a separate goroutine
 	go func() {
-		httpMux := http.NewServeMux()
-		httpMux.HandleFunc("/o/upload", corsMiddleware(handleFileUpload))
-		httpMux.HandleFunc("/o/files/", corsMiddleware(handleFileServe))
-		httpMux.HandleFunc("/o/delete/", corsMiddleware(handleFileDelete))
-		httpMux.HandleFunc("/o/purge/", corsMiddleware(handleRoomPurge))
-
-		http_port := 8090
-
 		log.Printf("HTTP file server starting on port %d...", http_port)
-		if err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", http_port), httpMux); err != nil {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal("HTTP server error:", err)
 		}
 	}()
@@ -249,16 +449,35 @@ func main() {
 	wsMux.HandleFunc("/o/socket", handleWebSocket)
 
 	ws_port := 8100
-	log.Printf("WebSocket server starting on port %d...", ws_port)
-	if err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", ws_port), wsMux); err != nil {
-		log.Fatal("WebSocket server error:", err)
-	}
+	wsServer := &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", ws_port), Handler: wsMux}
+
+	go func() {
+		log.Printf("WebSocket server starting on port %d...", ws_port)
+		if err := wsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("WebSocket server error:", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, then stop accepting requests and write out
+	// any room content still waiting in the write-behind buffer.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Printf("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	httpServer.Shutdown(shutdownCtx)
+	wsServer.Shutdown(shutdownCtx)
+
+	flushAllRooms()
+	log.Printf("Flushed pending room content")
 }
 
 func addCORSHeaders(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 }
 
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -275,104 +494,147 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func startPingChecker() {
-	for {
-		time.Sleep(45 * time.Second) // Check every 45 seconds
-		checkClientPings()
-	}
-}
-
 func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(32 << 20) // 32MB max memory
+	// Stream the form instead of buffering it, refusing bodies that can't
+	// possibly fit within the upload limit
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+uploadFormOverhead)
+	reader, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
 		return
 	}
 
-	roomCode := r.FormValue("roomCode")
+	var roomCode, uploadedBy string
+	var upload *stagedUpload
+	defer func() {
+		if upload != nil {
+			upload.discard()
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if isMaxBytesError(err) {
+				http.Error(w, fmt.Sprintf("File exceeds the maximum upload size of %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+			}
+			return
+		}
+
+		switch part.FormName() {
+		case "roomCode":
+			roomCode, err = readFormValue(part)
+		case "uploadedBy":
+			uploadedBy, err = readFormValue(part)
+		case "file":
+			if upload != nil {
+				part.Close()
+				http.Error(w, "Only one file can be uploaded at a time", http.StatusBadRequest)
+				return
+			}
+
+			// If the room is already known, stop as soon as its quota is used up
+			limit, quotaLimited := maxUploadSize, false
+			if roomCode != "" {
+				remaining, err := quotaRemaining(roomCode)
+				if err != nil {
+					part.Close()
+					log.Printf("Error checking upload quota for room %s: %v", roomCode, err)
+					http.Error(w, "Database error", http.StatusInternalServerError)
+					return
+				}
+				if remaining < limit {
+					limit, quotaLimited = remaining, true
+				}
+			}
+
+			upload, err = stageUpload(part, limit)
+			if errors.Is(err, errUploadTooLarge) {
+				part.Close()
+				if quotaLimited {
+					http.Error(w, "Room upload quota exceeded", http.StatusRequestEntityTooLarge)
+				} else {
+					http.Error(w, fmt.Sprintf("File exceeds the maximum upload size of %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+				}
+				return
+			}
+		}
+		part.Close()
+
+		if err != nil {
+			if isMaxBytesError(err) {
+				http.Error(w, fmt.Sprintf("File exceeds the maximum upload size of %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("Error reading upload: %v", err)
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			return
+		}
+	}
+
 	if roomCode == "" {
 		http.Error(w, "Room code is required", http.StatusBadRequest)
 		return
 	}
-
-	uploadedBy := r.FormValue("uploadedBy")
 	if uploadedBy == "" {
 		uploadedBy = "Unknown"
 	}
-
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	if upload == nil {
 		http.Error(w, "Failed to get file from form", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	// Generate unique filename with UUID
-	fileID := fmt.Sprintf("file_%d_%d", time.Now().UnixNano(), rand.Intn(10000))
-	filename := fmt.Sprintf("%s_%s", fileID, header.Filename)
-
-	// Create room directory if it doesn't exist
-	roomDir := filepath.Join(filesDir, roomCode)
-	if err := os.MkdirAll(roomDir, 0755); err != nil {
-		http.Error(w, "Failed to create room directory", http.StatusInternalServerError)
-		return
-	}
 
-	// Save file to disk
-	filePath := filepath.Join(roomDir, filename)
-	dst, err := os.Create(filePath)
+	// Trust the file's content rather than the type the client claims
+	mediaType, err := detectUploadType(upload.Path, upload.ContentType)
 	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		if errors.Is(err, errUploadType) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		} else {
+			log.Printf("Error detecting upload type: %v", err)
+			http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		}
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
-	}
+	fileID := fmt.Sprintf("file_%d_%d", time.Now().UnixNano(), rand.Intn(10000))
 
 	// Create media file object
 	mediaFile := MediaFile{
 		ID:         fileID,
-		Name:       header.Filename,
-		Type:       header.Header.Get("Content-Type"),
-		Size:       header.Size,
-		URL:        fmt.Sprintf("/files/%s/%s", roomCode, filename),
+		Name:       upload.Name,
+		Type:       mediaType,
+		Size:       upload.Size,
+		URL:        fmt.Sprintf("/files/%s/%s", roomCode, fileID),
 		UploadedAt: time.Now(),
 		UploadedBy: uploadedBy,
+		BlobHash:   upload.Hash,
 	}
 
-	// Save to database
-	if err := saveMediaFile(roomCode, mediaFile); err != nil {
-		log.Printf("Error saving media file to database: %v", err)
-		http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+	// Check the quota and record the file as one step
+	if err := commitUpload(roomCode, upload.Path, mediaFile); err != nil {
+		if errors.Is(err, errUploadTooLarge) {
+			http.Error(w, "Room upload quota exceeded", http.StatusRequestEntityTooLarge)
+		} else {
+			log.Printf("Error saving upload to room %s: %v", roomCode, err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		}
 		return
 	}
+	upload = nil
 
 	// Add to room and broadcast
-	roomsMutex.RLock()
-	room, exists := rooms[roomCode]
-	roomsMutex.RUnlock()
-
-	if exists {
-		room.mutex.Lock()
-		room.MediaFiles = append(room.MediaFiles, mediaFile)
-		room.mutex.Unlock()
-
-		// Broadcast to all clients in the room
-		mediaMsg := MediaMessage{
-			BaseMessage: BaseMessage{Type: MediaUpload, Code: roomCode},
-			Media:       mediaFile,
-		}
-		broadcastToRoom(room, mediaMsg, "")
-	}
+	announceMedia(roomCode, mediaFile)
+	queueThumbnail(roomCode, mediaFile)
 
 	// Return file info as JSON
 	w.Header().Set("Content-Type", "application/json")
@@ -380,16 +642,16 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleFileServe(w http.ResponseWriter, r *http.Request) {
-	// Extract room code and filename from URL path
-	path := r.URL.Path[9:] // Remove "/files/" prefix
+	// Extract room code and file ID from URL path
+	path := r.URL.Path[9:] // Remove "/o/files/" prefix
 	if path == "" {
 		http.Error(w, "Invalid file path", http.StatusBadRequest)
 		return
 	}
 
-	// Split path into room code and filename using forward slash
-	dir, filename := filepath.Split(path)
-	if dir == "" || filename == "" {
+	// Split path into room code and file ID using forward slash
+	dir, fileID := filepath.Split(path)
+	if dir == "" || fileID == "" {
 		http.Error(w, "Invalid file path format", http.StatusBadRequest)
 		return
 	}
@@ -397,18 +659,34 @@ func handleFileServe(w http.ResponseWriter, r *http.Request) {
 	// Remove trailing slash from directory part and use as room code
 	roomCode := filepath.Clean(dir)
 
-	// Construct full file path
-	filePath := filepath.Join(filesDir, roomCode, filename)
-
-	// Security check: ensure the file is within the allowed directory
-	absFilesDir, _ := filepath.Abs(filesDir)
-	absFilePath, _ := filepath.Abs(filePath)
-	relPath, err := filepath.Rel(absFilesDir, absFilePath)
-	if err != nil || filepath.IsAbs(relPath) || len(relPath) > 0 && relPath[0] == '.' {
-		http.Error(w, "Access denied", http.StatusForbidden)
+	media, err := store.GetMediaFile(roomCode, fileID)
+	var filePath string
+	if err == sql.ErrNoRows {
+		// Files from before the blob store are addressed by their name in
+		// the room directory
+		media = MediaFile{Name: fileID}
+		filePath = filepath.Join(filesDir, roomCode, fileID)
+	} else if err != nil {
+		log.Printf("Error retrieving media file %s: %v", fileID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if filePath = mediaFilePath(roomCode, media); filePath == "" {
+		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
+	// Security check: ensure a file named in the URL is within the allowed
+	// directory
+	if media.BlobHash == "" {
+		absFilesDir, _ := filepath.Abs(filesDir)
+		absFilePath, _ := filepath.Abs(filePath)
+		relPath, err := filepath.Rel(absFilesDir, absFilePath)
+		if err != nil || filepath.IsAbs(relPath) || len(relPath) > 0 && relPath[0] == '.' {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+	}
+
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
@@ -416,7 +694,7 @@ func handleFileServe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set headers to force download
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": media.Name}))
 	w.Header().Set("Content-Type", "application/octet-stream")
 
 	// Serve the file
@@ -447,8 +725,7 @@ func handleFileDelete(w http.ResponseWriter, r *http.Request) {
 	roomCode := filepath.Clean(dir)
 
 	// Get file info from database first
-	var filename, url string
-	err := db.QueryRow("SELECT name, url FROM media_files WHERE id = ? AND room_code = ?", fileID, roomCode).Scan(&filename, &url)
+	media, err := store.GetMediaFile(roomCode, fileID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "File not found", http.StatusNotFound)
@@ -458,32 +735,15 @@ func handleFileDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete file from filesystem
-	filePath := filepath.Join(filesDir, roomCode, filename)
-	if err := os.Remove(filePath); err != nil {
-		log.Printf("Warning: Could not delete file %s: %v", filePath, err)
-	}
-
-	// Delete from database
-	if err := deleteMediaFile(fileID); err != nil {
+	// Delete from database, and the file itself if nothing else uses it
+	if err := deleteMediaFile(roomCode, media); err != nil {
 		http.Error(w, "Failed to delete file metadata", http.StatusInternalServerError)
 		return
 	}
 
 	// Remove from room and broadcast
-	roomsMutex.RLock()
-	room, exists := rooms[roomCode]
-	roomsMutex.RUnlock()
-
-	if exists {
-		room.mutex.Lock()
-		for i, media := range room.MediaFiles {
-			if media.ID == fileID {
-				room.MediaFiles = append(room.MediaFiles[:i], room.MediaFiles[i+1:]...)
-				break
-			}
-		}
-		room.mutex.Unlock()
+	rooms.do(roomCode, func(room *Room) {
+		removeRoomMedia(room, fileID)
 
 		// Broadcast to all clients in the room
 		mediaMsg := MediaMessage{
@@ -491,7 +751,7 @@ func handleFileDelete(w http.ResponseWriter, r *http.Request) {
 			Media:       MediaFile{ID: fileID},
 		}
 		broadcastToRoom(room, mediaMsg, "")
-	}
+	})
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("File deleted successfully"))
@@ -512,135 +772,327 @@ func handleRoomPurge(w http.ResponseWriter, r *http.Request) {
 
 	roomCode := path
 
-	// First, disconnect all clients and remove room from memory
-	roomsMutex.Lock()
-	room, exists := rooms[roomCode]
-	if exists {
-		// Disconnect all clients
-		room.mutex.Lock()
-		for _, client := range room.Clients {
-			if client.Conn != nil {
-				client.Conn.Close()
-			}
-		}
-		room.mutex.Unlock()
-
-		// Remove room from memory
-		delete(rooms, roomCode)
+	// Only the room's owner may purge it
+	userID := r.URL.Query().Get("userId")
+	if userID == "" || !requestHasToken(r, userID) {
+		http.Error(w, "Invalid token for userId", http.StatusUnauthorized)
+		return
+	}
+	members, err := store.GetRoomMembers(roomCode)
+	if err != nil {
+		log.Printf("Error retrieving members for room %s: %v", roomCode, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !slices.ContainsFunc(members, func(m RoomMember) bool { return m.UserID == userID && m.Role == RoleOwner }) {
+		http.Error(w, "Only the room owner can purge it", http.StatusForbidden)
+		return
 	}
-	roomsMutex.Unlock()
+
+	// First, disconnect all clients and retire the room actor
+	rooms.call(roomCode, func(room *Room) {
+		room.disconnectAll()
+		room.markContentClean()
+		room.retire()
+	})
 
 	// Delete from database - room content
-	if err := deleteRoomContent(roomCode); err != nil {
+	if err := store.DeleteRoomContent(roomCode); err != nil {
 		log.Printf("Error deleting room content: %v", err)
 		http.Error(w, "Failed to delete room content", http.StatusInternalServerError)
 		return
 	}
 
+	// Delete the room's revision history
+	if err := store.DeleteRoomRevisions(roomCode); err != nil {
+		log.Printf("Error deleting room revisions: %v", err)
+		http.Error(w, "Failed to delete room history", http.StatusInternalServerError)
+		return
+	}
+
 	// Delete all comments for this room
-	if err := deleteRoomComments(roomCode); err != nil {
+	if err := store.DeleteRoomComments(roomCode); err != nil {
 		log.Printf("Error deleting room comments: %v", err)
 		http.Error(w, "Failed to delete room comments", http.StatusInternalServerError)
 		return
 	}
 
 	// Delete all media files for this room
-	if err := deleteRoomMedia(roomCode); err != nil {
+	if err := deleteRoomMediaFiles(roomCode); err != nil {
 		log.Printf("Error deleting room media files: %v", err)
 		http.Error(w, "Failed to delete room media files", http.StatusInternalServerError)
 		return
 	}
 
-	// Delete physical files from filesystem
-	roomDir := filepath.Join(filesDir, roomCode)
-	if err := os.RemoveAll(roomDir); err != nil {
-		log.Printf("Warning: Could not delete room directory %s: %v", roomDir, err)
+	// Delete the room's member list
+	if err := store.DeleteRoomMembers(roomCode); err != nil {
+		log.Printf("Error deleting room members: %v", err)
+		http.Error(w, "Failed to delete room members", http.StatusInternalServerError)
+		return
 	}
 
+	// Delete unfinished uploads; their partial files go with the room directory
+	if err := store.DeleteRoomUploads(roomCode); err != nil {
+		log.Printf("Error deleting room uploads: %v", err)
+		http.Error(w, "Failed to delete room uploads", http.StatusInternalServerError)
+		return
+	}
+
+	// Delete the room's chat
+	if err := store.DeleteRoomChat(roomCode); err != nil {
+		log.Printf("Error deleting room chat: %v", err)
+		http.Error(w, "Failed to delete room chat", http.StatusInternalServerError)
+		return
+	}
+
+	// Delete mentions pointing into the room
+	if err := store.DeleteRoomMentions(roomCode); err != nil {
+		log.Printf("Error deleting room mentions: %v", err)
+		http.Error(w, "Failed to delete room mentions", http.StatusInternalServerError)
+		return
+	}
+
+	// Delete physical files from filesystem
+	removeRoomDir(roomCode)
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Room purged successfully"))
 }
 
-func checkClientPings() {
-	roomsMutex.RLock()
-	defer roomsMutex.RUnlock()
+func handleRoomHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomCode := r.PathValue("code")
+	revisions, err := store.GetRoomRevisions(roomCode)
+	if err != nil {
+		log.Printf("Error retrieving history for room %s: %v", roomCode, err)
+		http.Error(w, "Failed to retrieve room history", http.StatusInternalServerError)
+		return
+	}
+	if revisions == nil {
+		revisions = []RoomRevision{}
+	}
 
-	for roomCode, room := range rooms {
-		room.mutex.Lock()
-		var disconnectedClients []string
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
 
-		for clientID, client := range room.Clients {
-			if time.Since(client.LastPing) > 60*time.Second { // 60 second timeout
-				disconnectedClients = append(disconnectedClients, clientID)
-			}
-		}
+func handleRoomRevision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		for _, clientID := range disconnectedClients {
-			if client, exists := room.Clients[clientID]; exists {
-				client.Conn.Close()
-				delete(room.Clients, clientID)
-				log.Printf("Client %s timed out in room %s", clientID, roomCode)
+	roomCode := r.PathValue("code")
+	number, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil {
+		http.Error(w, "Invalid revision number", http.StatusBadRequest)
+		return
+	}
 
-				// Broadcast user left
-				userLeftMsg := UserMessage{
-					BaseMessage: BaseMessage{Type: UserLeft, Code: roomCode},
-					User:        client.User,
-				}
-				broadcastToRoom(room, userLeftMsg, "")
-			}
+	revision, err := store.GetRoomRevision(roomCode, number)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving revision %d for room %s: %v", number, roomCode, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
 		}
-		room.mutex.Unlock()
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revision)
 }
 
-func startRoomCleanup() {
-	for {
-		time.Sleep(2 * time.Hour)
-		deleteOldRooms()
+func handleRoomRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-}
 
-func deleteOldRooms() {
-	roomsMutex.Lock()
-	defer roomsMutex.Unlock()
+	roomCode := r.PathValue("code")
+
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID != "" && !requestHasToken(r, req.UserID) {
+		http.Error(w, "Invalid token for userId", http.StatusUnauthorized)
+		return
+	}
+
+	revision, err := store.GetRoomRevision(roomCode, req.Number)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving revision %d for room %s: %v", req.Number, roomCode, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var newNumber int
+	if !rooms.call(roomCode, func(room *Room) {
+		newNumber, err = restoreRoomRevision(room, roomCode, revision, "", req.UserID)
+	}) {
+		newNumber, err = restoreStoredRoom(roomCode, revision, req.UserID)
+	}
+	if err != nil {
+		log.Printf("Error restoring revision %d for room %s: %v", req.Number, roomCode, err)
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
 
 	now := time.Now()
-	rows, err := db.Query("SELECT code FROM rooms WHERE created_at < ?", now.Add(-24*time.Hour))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RoomRevision{
+		Number:    newNumber,
+		AuthorID:  req.UserID,
+		Timestamp: now,
+		UpdatedAt: now,
+		Size:      len(revision.Content),
+	})
+}
+
+// handleRoomDiff compares two stored revisions. Revision 0 stands for the empty
+// document. The response is JSON with both hunks and the unified text, or just
+// the unified text with ?format=unified.
+func handleRoomDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomCode := r.PathValue("code")
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
 	if err != nil {
-		log.Printf("Error querying old rooms: %v", err)
+		http.Error(w, "Invalid from revision", http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, "Invalid to revision", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	var roomCode string
-	for rows.Next() {
-		if err := rows.Scan(&roomCode); err != nil {
-			log.Printf("Error scanning room code: %v", err)
+	contents := make([]string, 2)
+	for i, number := range []int{from, to} {
+		if number == 0 {
 			continue
 		}
+		revision, err := store.GetRoomRevision(roomCode, number)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, fmt.Sprintf("Revision %d not found", number), http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving revision %d for room %s: %v", number, roomCode, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+			}
+			return
+		}
+		contents[i] = revision.Content
+	}
 
-		deleteRoomContent(roomCode)
-		deleteRoomComments(roomCode)
-		deleteRoomMedia(roomCode)
+	lines, err := diffLines(splitLines(contents[0]), splitLines(contents[1]))
+	if err != nil {
+		http.Error(w, "Revisions differ too much to diff", http.StatusRequestEntityTooLarge)
+		return
+	}
+	hunks := buildHunks(lines, diffContextLines)
+	unified := formatUnifiedDiff(
+		fmt.Sprintf("%s@%d", roomCode, from),
+		fmt.Sprintf("%s@%d", roomCode, to),
+		hunks,
+	)
 
-		if _, exists := rooms[roomCode]; exists {
-			delete(rooms, roomCode)
-			log.Printf("Deleted room %s (older than 1 day)", roomCode)
-		}
+	if r.URL.Query().Get("format") == "unified" {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		w.Write([]byte(unified))
+		return
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error after scanning rows: %v", err)
+	if hunks == nil {
+		hunks = []DiffHunk{}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RoomDiff{From: from, To: to, Unified: unified, Hunks: hunks})
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func handleCommentVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomCode := r.PathValue("code")
+	commentID := r.PathValue("id")
+	versions, err := store.GetCommentVersions(roomCode, commentID)
 	if err != nil {
-		log.Printf("Error upgrading connection: %v", err)
+		log.Printf("Error retrieving versions of comment %s: %v", commentID, err)
+		http.Error(w, "Failed to retrieve comment versions", http.StatusInternalServerError)
 		return
 	}
-	defer conn.Close()
+	if versions == nil {
+		versions = []CommentVersion{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+func startRoomCleanup() {
+	for {
+		time.Sleep(2 * time.Hour)
+		deleteOldRooms()
+		expireUploads()
+	}
+}
+
+func deleteOldRooms() {
+	now := time.Now()
+	roomCodes, err := store.RoomsSavedBefore(now.Add(-24 * time.Hour))
+	if err != nil {
+		log.Printf("Error querying old rooms: %v", err)
+		return
+	}
+
+	for _, roomCode := range roomCodes {
+		// Stop the room first so it can't write anything back afterwards
+		if rooms.call(roomCode, func(room *Room) {
+			room.disconnectAll()
+			room.markContentClean()
+			room.retire()
+		}) {
+			log.Printf("Deleted room %s (older than 1 day)", roomCode)
+		}
+
+		store.DeleteRoomContent(roomCode)
+		store.DeleteRoomRevisions(roomCode)
+		store.DeleteRoomComments(roomCode)
+		deleteRoomMediaFiles(roomCode)
+		store.DeleteRoomMembers(roomCode)
+		store.DeleteRoomUploads(roomCode)
+		store.DeleteRoomChat(roomCode)
+		store.DeleteRoomMentions(roomCode)
+		removeRoomDir(roomCode)
+	}
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading connection: %v", err)
+		return
+	}
+	client := newClient(conn)
+	defer client.close()
+	defer connections.remove(client)
 
 	log.Printf("New client connected from %s", conn.RemoteAddr())
 
@@ -667,23 +1119,47 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 		switch baseMsg.Type {
 		case JoinRoom:
-			clientID = handleJoinRoom(conn, message, &currentRoom)
+			clientID = handleJoinRoom(client, message, &currentRoom)
 		case TextUpdate:
-			handleTextUpdate(conn, message, currentRoom, clientID)
+			handleTextUpdate(client, message, currentRoom, clientID)
+		case TextOps:
+			handleTextOps(client, message, currentRoom, clientID)
+		case CRDTUpdateType:
+			handleCRDTUpdate(client, message, currentRoom, clientID)
+		case RestoreRevision:
+			handleRestoreRevision(client, message, currentRoom, clientID)
 		case Ping:
-			handlePing(conn, message, currentRoom, clientID)
+			handlePing(client, message, currentRoom, clientID)
 		case CommentAdd:
-			handleCommentAdd(conn, message, currentRoom, clientID)
+			handleCommentAdd(client, message, currentRoom, clientID)
 		case CommentUpdate:
-			handleCommentUpdate(conn, message, currentRoom, clientID)
+			handleCommentUpdate(client, message, currentRoom, clientID)
 		case CommentDelete:
-			handleCommentDelete(conn, message, currentRoom, clientID)
+			handleCommentDelete(client, message, currentRoom, clientID)
+		case CommentReply:
+			handleCommentReply(client, message, currentRoom, clientID)
+		case CommentResolve:
+			handleCommentResolve(client, message, currentRoom, clientID)
+		case CommentReopen:
+			handleCommentReopen(client, message, currentRoom, clientID)
+		case CommentsSync:
+			handleCommentsSync(client, message, currentRoom, clientID)
+		case CommentReact:
+			handleCommentReact(client, message, currentRoom, clientID)
+		case MemberRoleType:
+			handleMemberRole(client, message, currentRoom, clientID)
+		case ChatMessageType:
+			handleChatMessage(client, message, currentRoom, clientID)
+		case ChatSync:
+			handleChatSync(client, message, currentRoom, clientID)
+		case MentionsRead:
+			handleMentionsRead(client, message, currentRoom, clientID)
 		case UserActivity:
-			handleUserActivity(conn, message, currentRoom, clientID)
+			handleUserActivity(client, message, currentRoom, clientID)
 		case MediaUpload:
-			handleMediaUpload(conn, message, currentRoom, clientID)
+			handleMediaUpload(client, message, currentRoom, clientID)
 		case MediaDelete:
-			handleMediaDelete(conn, message, currentRoom, clientID)
+			handleMediaDelete(client, message, currentRoom, clientID)
 		default:
 			log.Printf("Unknown message type received: %s", baseMsg.Type)
 		}
@@ -708,14 +1184,20 @@ func generateUserName() string {
 func broadcastToRoom(room *Room, message interface{}, excludeClientID string) {
 	for clientID, client := range room.Clients {
 		if clientID != excludeClientID {
-			if err := client.Conn.WriteJSON(message); err != nil {
-				log.Printf("Error broadcasting to client %s: %v", clientID, err)
-			}
+			client.send(message)
 		}
 	}
 }
 
-func handleJoinRoom(conn *websocket.Conn, message []byte, currentRoom *string) string {
+func sendError(client *Client, roomCode string, request MessageType, message string) {
+	client.send(ErrorMessage{
+		BaseMessage: BaseMessage{Type: ErrorType, Code: roomCode},
+		Request:     request,
+		Message:     message,
+	})
+}
+
+func handleJoinRoom(client *Client, message []byte, currentRoom *string) string {
 	var joinMsg JoinRoomMessage
 	if err := json.Unmarshal(message, &joinMsg); err != nil {
 		log.Printf("Error unmarshaling join room message: %v", err)
@@ -723,7 +1205,7 @@ func handleJoinRoom(conn *websocket.Conn, message []byte, currentRoom *string) s
 	}
 
 	if *currentRoom != "" {
-		leaveRoom(*currentRoom, "")
+		leaveRoom(*currentRoom, client.ID)
 	}
 
 	*currentRoom = joinMsg.Code
@@ -742,100 +1224,119 @@ func handleJoinRoom(conn *websocket.Conn, message []byte, currentRoom *string) s
 	}
 	user.LastSeen = time.Now()
 
-	log.Printf("Client %s joining room: %s as user %s", conn.RemoteAddr(), *currentRoom, user.Name)
+	// Anyone without the token for the ID they asked for joins under a
+	// fresh one instead
+	token, ok := claimUserID(user.ID, joinMsg.Token)
+	if !ok {
+		log.Printf("Client %s has no valid token for user %s", client.Conn.RemoteAddr(), user.ID)
+		user.ID = clientID
+		token, _ = claimUserID(user.ID, "")
+	}
+	if token != "" {
+		client.send(UserTokenMessage{
+			BaseMessage: BaseMessage{Type: UserToken, Code: joinMsg.Code},
+			UserID:      user.ID,
+			Token:       token,
+		})
+	}
 
-	roomsMutex.Lock()
-	if _, exists := rooms[*currentRoom]; !exists {
-		content, err := getRoomContent(*currentRoom)
-		if err != nil {
-			log.Printf("Error retrieving content for room %s: %v", *currentRoom, err)
-		}
+	log.Printf("Client %s joining room: %s as user %s", client.Conn.RemoteAddr(), *currentRoom, user.Name)
 
-		comments, err := getRoomComments(*currentRoom)
-		if err != nil {
-			log.Printf("Error retrieving comments for room %s: %v", *currentRoom, err)
+	// Everything is queued on the room's goroutine so the new client sees its
+	// initial state before any change broadcast after it joined.
+	roomCode := *currentRoom
+	join := func(room *Room) {
+		user.Role = room.addMember(user)
+		client.ID = clientID
+		client.User = user
+		client.LastPing = time.Now()
+		client.SupportsOps = joinMsg.SupportsOps
+		client.UsesCRDT = joinMsg.StateVector != nil
+		client.CRDTSeq = min(max(joinMsg.Seq, 0), room.Doc.Seq())
+		client.CRDTClient = joinMsg.CRDTClient
+		room.Clients[clientID] = client
+
+		// Send initial content, or just what a CRDT client is missing
+		if joinMsg.StateVector != nil {
+			if joinMsg.Update != nil {
+				applyCRDTUpdate(room, roomCode, *joinMsg.Update, clientID)
+			}
+			room.Doc.Ack(client.CRDTClient, client.CRDTSeq, time.Now())
+
+			syncMsg := CRDTSyncMessage{
+				BaseMessage: BaseMessage{Type: CRDTSync, Code: roomCode},
+				StateVector: room.Doc.StateVector(),
+				Revision:    room.Revision,
+				Seq:         room.Doc.Seq(),
+			}
+			if joinMsg.Seq < room.Doc.CompactedSeq() {
+				// The client may still refer to tombstones that are gone
+				syncMsg.Update = room.Doc.Snapshot()
+				syncMsg.Reset = true
+			} else {
+				syncMsg.Update = room.Doc.MissingUpdate(joinMsg.StateVector)
+			}
+			client.send(syncMsg)
+		} else {
+			client.send(InitialContentMessage{
+				BaseMessage: BaseMessage{
+					Type: InitialContent,
+					Code: roomCode,
+				},
+				Content:  room.Content,
+				Revision: room.Revision,
+			})
 		}
 
-		mediaFiles, err := getRoomMedia(*currentRoom)
-		if err != nil {
-			log.Printf("Error retrieving media for room %s: %v", *currentRoom, err)
-		}
-
-		rooms[*currentRoom] = &Room{
-			Content:    content,
-			Clients:    make(map[string]*Client),
-			Comments:   comments,
-			MediaFiles: mediaFiles,
-			mutex:      sync.RWMutex{},
-			CreatedAt:  time.Now(),
-		}
-		log.Printf("Created new room: %s", *currentRoom)
-	}
-	room := rooms[*currentRoom]
-	room.mutex.Lock()
-	room.Clients[clientID] = &Client{
-		Conn:     conn,
-		User:     user,
-		LastPing: time.Now(),
-	}
-	room.mutex.Unlock()
-	roomsMutex.Unlock()
-
-	// Send initial content
-	initialMsg := InitialContentMessage{
-		BaseMessage: BaseMessage{
-			Type: InitialContent,
-			Code: *currentRoom,
-		},
-		Content: room.Content,
-	}
+		// Send comments
+		client.send(commentsSyncMessage(room, joinMsg.HideResolved))
 
-	if err := conn.WriteJSON(initialMsg); err != nil {
-		log.Printf("Error sending initial content to %s: %v", conn.RemoteAddr(), err)
-	}
+		// Send the latest page of chat
+		if chatMsg, err := chatSyncMessage(roomCode, 0); err != nil {
+			log.Printf("Error loading chat for room %s: %v", roomCode, err)
+		} else {
+			client.send(chatMsg)
+		}
 
-	// Send comments
-	commentsMsg := CommentsMessage{
-		BaseMessage: BaseMessage{Type: CommentsSync, Code: *currentRoom},
-		Comments:    room.Comments,
-	}
-	if err := conn.WriteJSON(commentsMsg); err != nil {
-		log.Printf("Error sending comments to %s: %v", conn.RemoteAddr(), err)
-	}
+		// Send media files. The list is copied since the room goes on
+		// changing it while the message waits to be written.
+		mediaMsg := MediaSyncMessage{
+			BaseMessage: BaseMessage{Type: MediaSync, Code: roomCode},
+			MediaFiles:  slices.Clone(room.MediaFiles),
+		}
+		client.send(mediaMsg)
 
-	// Send media files
-	mediaMsg := MediaSyncMessage{
-		BaseMessage: BaseMessage{Type: MediaSync, Code: *currentRoom},
-		MediaFiles:  room.MediaFiles,
-	}
-	if err := conn.WriteJSON(mediaMsg); err != nil {
-		log.Printf("Error sending media to %s: %v", conn.RemoteAddr(), err)
-	}
+		// Send current users
+		var users []User
+		for _, member := range room.Clients {
+			users = append(users, member.User)
+		}
+		usersMsg := UsersMessage{
+			BaseMessage: BaseMessage{Type: UsersSync, Code: roomCode},
+			Users:       users,
+		}
+		client.send(usersMsg)
 
-	// Send current users
-	var users []User
-	for _, client := range room.Clients {
-		users = append(users, client.User)
-	}
-	usersMsg := UsersMessage{
-		BaseMessage: BaseMessage{Type: UsersSync, Code: *currentRoom},
-		Users:       users,
+		// Broadcast user joined to others
+		userJoinedMsg := UserMessage{
+			BaseMessage: BaseMessage{Type: UserJoined, Code: roomCode},
+			User:        user,
+		}
+		broadcastToRoom(room, userJoinedMsg, clientID)
 	}
-	if err := conn.WriteJSON(usersMsg); err != nil {
-		log.Printf("Error sending users to %s: %v", conn.RemoteAddr(), err)
+	// The room may retire between acquire and join; a fresh actor is spawned
+	// on the next attempt.
+	for !rooms.acquire(roomCode).call(join) {
 	}
 
-	// Broadcast user joined to others
-	userJoinedMsg := UserMessage{
-		BaseMessage: BaseMessage{Type: UserJoined, Code: *currentRoom},
-		User:        user,
-	}
-	broadcastToRoom(room, userJoinedMsg, clientID)
+	// Mentions follow the user rather than the room
+	connections.add(user.ID, client)
+	sendMentionInbox(client, roomCode, user.ID)
 
 	return clientID
 }
 
-func handleTextUpdate(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
+func handleTextUpdate(client *Client, message []byte, currentRoom string, clientID string) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
@@ -846,57 +1347,327 @@ func handleTextUpdate(conn *websocket.Conn, message []byte, currentRoom string,
 		return
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
+	// Legacy clients send the whole document, so diff it into ops against the
+	// current revision and feed it through the same path as text-ops.
+	rooms.do(currentRoom, func(room *Room) {
+		ops := diffToOps(room.Content, updateMsg.Content)
+		if len(ops) == 0 {
+			return
+		}
+		rec, err := applyRoomOps(room, clientID, room.Revision, ops)
+		if err != nil {
+			log.Printf("Error applying text update in room %s: %v", currentRoom, err)
+			return
+		}
+
+		log.Printf("Broadcasting text update in room %s from client %s", currentRoom, clientID)
+
+		commitTextChange(room, currentRoom, rec, room.Doc.ApplyText(room.Content), clientID)
+	})
+}
+
+func handleTextOps(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
+	}
+
+	var opsMsg TextOpsMessage
+	if err := json.Unmarshal(message, &opsMsg); err != nil {
+		log.Printf("Error unmarshaling text ops message: %v", err)
+		return
+	}
+
+	rooms.do(currentRoom, func(room *Room) {
+		if client, exists := room.Clients[clientID]; exists {
+			client.SupportsOps = true
+		}
+
+		rec, err := applyRoomOps(room, clientID, opsMsg.Revision, opsMsg.Ops)
+		if err != nil {
+			// The client is out of sync; send it the current document so it can
+			// start again from a known revision.
+			log.Printf("Rejecting text ops in room %s from client %s: %v", currentRoom, clientID, err)
+			resyncMsg := InitialContentMessage{
+				BaseMessage: BaseMessage{Type: InitialContent, Code: currentRoom},
+				Content:     room.Content,
+				Revision:    room.Revision,
+			}
+			client.send(resyncMsg)
+			return
+		}
+
+		if rec != nil {
+			commitTextChange(room, currentRoom, rec, room.Doc.ApplyText(room.Content), clientID)
+		}
+
+		ackMsg := TextOpsAckMessage{
+			BaseMessage: BaseMessage{Type: TextOpsAck, Code: currentRoom},
+			Revision:    room.Revision,
+		}
+		client.send(ackMsg)
+	})
+}
+
+func handleCRDTUpdate(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
+	}
 
-	if !exists {
+	var updateMsg CRDTUpdateMessage
+	if err := json.Unmarshal(message, &updateMsg); err != nil {
+		log.Printf("Error unmarshaling CRDT update message: %v", err)
 		return
 	}
 
-	room.mutex.Lock()
-	room.Content = updateMsg.Content
-	room.mutex.Unlock()
+	rooms.do(currentRoom, func(room *Room) {
+		if client, exists := room.Clients[clientID]; exists {
+			client.UsesCRDT = true
+			client.CRDTSeq = max(client.CRDTSeq, min(updateMsg.Seq, room.Doc.Seq()))
+		}
+
+		applyCRDTUpdate(room, currentRoom, updateMsg.Update, clientID)
+	})
+}
 
-	if err := saveRoomContent(currentRoom, room.Content); err != nil {
-		log.Printf("Error saving content for room %s: %v", currentRoom, err)
+// applyCRDTUpdate merges a CRDT update from clientID into the room and passes
+// on whatever was new. It must run on the room's goroutine.
+func applyCRDTUpdate(room *Room, roomCode string, update CRDTUpdate, clientID string) {
+	room.flushForAuthor(room.authorOf(clientID))
+	applied := room.Doc.Apply(update)
+	if applied.isEmpty() {
+		return
 	}
 
-	log.Printf("Broadcasting text update in room %s from client %s", currentRoom, clientID)
+	// Mirror the merged document into the op log so OT and legacy clients
+	// see the same text.
+	var rec *textOpsRecord
+	if ops := diffToOps(room.Content, room.Doc.String()); len(ops) > 0 {
+		var err error
+		rec, err = applyRoomOps(room, clientID, room.Revision, ops)
+		if err != nil {
+			log.Printf("Error applying CRDT update in room %s: %v", roomCode, err)
+			return
+		}
+	}
 
-	room.mutex.RLock()
-	broadcastToRoom(room, updateMsg, clientID)
-	room.mutex.RUnlock()
+	commitTextChange(room, roomCode, rec, applied, clientID)
 }
 
-func handlePing(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
+func handleRestoreRevision(client *Client, message []byte, currentRoom string, clientID string) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
+	var restoreMsg RestoreRevisionMessage
+	if err := json.Unmarshal(message, &restoreMsg); err != nil {
+		log.Printf("Error unmarshaling restore revision message: %v", err)
+		return
+	}
 
-	if !exists {
+	revision, err := store.GetRoomRevision(currentRoom, restoreMsg.Number)
+	if err == sql.ErrNoRows {
+		sendError(client, currentRoom, RestoreRevision, "Revision not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving revision %d for room %s: %v", restoreMsg.Number, currentRoom, err)
+		sendError(client, currentRoom, RestoreRevision, "Could not load revision")
 		return
 	}
 
-	room.mutex.Lock()
+	rooms.do(currentRoom, func(room *Room) {
+		var userID string
+		if client, exists := room.Clients[clientID]; exists {
+			userID = client.User.ID
+		}
+
+		if _, err := restoreRoomRevision(room, currentRoom, revision, clientID, userID); err != nil {
+			log.Printf("Error restoring revision %d for room %s: %v", restoreMsg.Number, currentRoom, err)
+			sendError(client, currentRoom, RestoreRevision, "Could not restore revision")
+		}
+	})
+}
+
+// restoreRoomRevision rolls a live room back to revision, records the result
+// as a new revision and broadcasts it to every client, including the one that
+// asked for it. It must run on the room's goroutine.
+func restoreRoomRevision(room *Room, roomCode string, revision RoomRevision, clientID, userID string) (int, error) {
+	// Pending edits keep a revision of their own, even the restorer's
+	room.flushContentLogged()
+
+	var rec *textOpsRecord
+	if ops := diffToOps(room.Content, revision.Content); len(ops) > 0 {
+		var err error
+		rec, err = applyRoomOps(room, clientID, room.Revision, ops)
+		if err != nil {
+			return 0, err
+		}
+	}
+	update := room.Doc.ApplyText(room.Content)
+
+	// Write through immediately so the restore gets a revision of its own.
+	room.markContentDirty(userID)
+	newNumber, err := room.flushContent(RevisionForce)
+	if err != nil {
+		return 0, err
+	}
+
+	broadcastTextChange(room, roomCode, rec, update, "")
+	restoredMsg := RevisionRestoredMessage{
+		BaseMessage: BaseMessage{Type: RevisionRestored, Code: roomCode},
+		Number:      revision.Number,
+		NewNumber:   newNumber,
+		UserID:      userID,
+	}
+	broadcastToRoom(room, restoredMsg, "")
+
+	log.Printf("Room %s restored to revision %d as revision %d", roomCode, revision.Number, newNumber)
+	return newNumber, nil
+}
+
+// restoreStoredRoom restores a revision for a room nobody currently has open.
+func restoreStoredRoom(roomCode string, revision RoomRevision, userID string) (int, error) {
+	content, err := store.GetRoomContent(roomCode)
+	if err != nil {
+		return 0, err
+	}
+	crdtState, err := store.GetRoomCRDT(roomCode)
+	if err != nil {
+		return 0, err
+	}
+
+	doc := loadCRDTDoc(crdtState, content)
+	doc.ApplyText(revision.Content)
+	if err := store.SaveRoomContent(roomCode, revision.Content, doc.Encode()); err != nil {
+		return 0, err
+	}
+	return store.SaveRoomRevision(roomCode, userID, revision.Content, RevisionForce)
+}
+
+// commitTextChange queues the room's content, CRDT state and history for
+// writing and broadcasts the change to everyone but the client that made it. rec may be
+// nil when only CRDT metadata changed. It must run on the room's goroutine.
+func commitTextChange(room *Room, roomCode string, rec *textOpsRecord, update CRDTUpdate, clientID string) {
+	room.markContentDirty(room.authorOf(clientID))
+
+	broadcastTextChange(room, roomCode, rec, update, clientID)
+}
+
+// authorOf returns the user ID edits from clientID are recorded under.
+func (room *Room) authorOf(clientID string) string {
 	if client, exists := room.Clients[clientID]; exists {
-		client.LastPing = time.Now()
-		client.User.LastSeen = time.Now()
+		return client.User.ID
+	}
+	return clientID
+}
+
+// applyRoomOps transforms ops made against baseRevision over everything the
+// room has applied since, applies the result and appends it to the op log.
+// It returns nil when the ops collapse to nothing. It must run on the
+// room's goroutine.
+func applyRoomOps(room *Room, clientID string, baseRevision int, ops []TextOp) (*textOpsRecord, error) {
+	if baseRevision > room.Revision || baseRevision < room.Revision-len(room.OpLog) {
+		return nil, fmt.Errorf("unknown base revision %d (current %d)", baseRevision, room.Revision)
+	}
+	room.flushForAuthor(room.authorOf(clientID))
+
+	for _, rec := range room.OpLog[len(room.OpLog)-(room.Revision-baseRevision):] {
+		ops, _ = transformOps(ops, rec.Ops)
 	}
-	room.mutex.Unlock()
+
+	var filtered []TextOp
+	for _, op := range ops {
+		if !op.isNoop() {
+			filtered = append(filtered, op)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, nil
+	}
+
+	content, ok := applyOps(room.Content, filtered)
+	if !ok {
+		return nil, fmt.Errorf("ops out of range at revision %d", room.Revision)
+	}
+	room.remapCommentAnchors(filtered)
+	room.transformPresence(clientID, filtered)
+
+	room.Content = content
+	room.Revision++
+	room.OpLog = append(room.OpLog, textOpsRecord{Revision: room.Revision, ClientID: clientID, Ops: filtered})
+	if len(room.OpLog) > maxOpLogSize {
+		room.OpLog = room.OpLog[len(room.OpLog)-maxOpLogSize:]
+	}
+	return &room.OpLog[len(room.OpLog)-1], nil
+}
+
+// broadcastTextChange sends an applied change to every other client: the CRDT
+// update to CRDT clients, ops to clients that speak text-ops and the full
+// document to everyone else. It must run on the room's goroutine so revisions
+// go out in order.
+func broadcastTextChange(room *Room, roomCode string, rec *textOpsRecord, update CRDTUpdate, excludeClientID string) {
+	crdtMsg := CRDTUpdateMessage{
+		BaseMessage: BaseMessage{Type: CRDTUpdateType, Code: roomCode},
+		Update:      update,
+		Seq:         room.Doc.Seq(),
+	}
+	updateMsg := TextUpdateMessage{
+		BaseMessage: BaseMessage{Type: TextUpdate, Code: roomCode},
+		Content:     room.Content,
+	}
+	var opsMsg TextOpsMessage
+	if rec != nil {
+		opsMsg = TextOpsMessage{
+			BaseMessage: BaseMessage{Type: TextOps, Code: roomCode},
+			Revision:    rec.Revision,
+			Ops:         rec.Ops,
+		}
+		if client, exists := room.Clients[rec.ClientID]; exists {
+			opsMsg.UserID = client.User.ID
+		}
+	}
+
+	for clientID, client := range room.Clients {
+		if clientID == excludeClientID {
+			continue
+		}
+		switch {
+		case client.UsesCRDT:
+			if !update.isEmpty() {
+				client.send(crdtMsg)
+			}
+		case rec == nil:
+		case client.SupportsOps:
+			client.send(opsMsg)
+		default:
+			client.send(updateMsg)
+		}
+	}
+
+	// Comments that moved with the edit follow the text they are on
+	room.broadcastMovedComments()
+}
+
+func handlePing(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
+	}
+
+	rooms.do(currentRoom, func(room *Room) {
+		if client, exists := room.Clients[clientID]; exists {
+			client.LastPing = time.Now()
+			client.User.LastSeen = time.Now()
+		}
+	})
 
 	// Send pong response
 	pongMsg := PongMessage{
 		BaseMessage: BaseMessage{Type: Pong, Code: currentRoom},
 	}
-	conn.WriteJSON(pongMsg)
+	client.send(pongMsg)
 }
 
-func handleCommentAdd(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
+func handleCommentAdd(client *Client, message []byte, currentRoom string, clientID string) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
@@ -907,208 +1678,509 @@ func handleCommentAdd(conn *websocket.Conn, message []byte, currentRoom string,
 		return
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
-
-	if !exists {
-		return
-	}
-
-	// Generate comment ID and set timestamp
+	// Generate comment ID and set timestamp. Replies go through comment-reply.
 	commentMsg.Comment.ID = fmt.Sprintf("comment_%d", time.Now().UnixNano())
 	commentMsg.Comment.Timestamp = time.Now()
+	commentMsg.Comment.ParentID = nil
 
-	// Set author from client user
-	room.mutex.RLock()
-	if client, exists := room.Clients[clientID]; exists {
-		commentMsg.Comment.Author = client.User.Name
-		commentMsg.Comment.AuthorID = client.User.ID
+	rooms.do(currentRoom, func(room *Room) {
+		// Set author from client user
+		if client, exists := room.Clients[clientID]; exists {
+			commentMsg.Comment.Author = client.User.Name
+			commentMsg.Comment.AuthorID = client.User.ID
+		}
+
+		// Save to database
+		if err := store.SaveComment(currentRoom, commentMsg.Comment); err != nil {
+			log.Printf("Error saving comment: %v", err)
+			return
+		}
+
+		// Add to room
+		room.Comments = append(room.Comments, commentMsg.Comment)
+
+		// Broadcast to all clients
+		broadcastToRoom(room, commentMsg, "")
+
+		notifyMentions(room, commentMsg.Comment, nil)
+	})
+}
+
+// handleCommentReply adds a comment to the thread of an existing one. Replies
+// to replies join the same thread, and every reply shares the line anchor of
+// the comment that started it.
+func handleCommentReply(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
 	}
-	room.mutex.RUnlock()
 
-	// Save to database
-	if err := saveComment(currentRoom, commentMsg.Comment); err != nil {
-		log.Printf("Error saving comment: %v", err)
+	var commentMsg CommentMessage
+	if err := json.Unmarshal(message, &commentMsg); err != nil {
+		log.Printf("Error unmarshaling comment reply message: %v", err)
+		return
+	}
+	if commentMsg.Comment.ParentID == nil {
 		return
 	}
 
-	// Add to room
-	room.mutex.Lock()
-	room.Comments = append(room.Comments, commentMsg.Comment)
-	room.mutex.Unlock()
+	reply := commentMsg.Comment
+	reply.ID = fmt.Sprintf("comment_%d", time.Now().UnixNano())
+	reply.Timestamp = time.Now()
+	reply.EditedAt = nil
 
-	// Broadcast to all clients
-	broadcastToRoom(room, commentMsg, "")
-}
+	rooms.do(currentRoom, func(room *Room) {
+		i := findComment(room.Comments, *reply.ParentID)
+		if i < 0 {
+			log.Printf("Reply to unknown comment %s in room %s", *reply.ParentID, currentRoom)
+			return
+		}
+		parent := room.Comments[i]
+		if parent.ParentID != nil {
+			if j := findComment(room.Comments, *parent.ParentID); j >= 0 {
+				parent = room.Comments[j]
+			}
+		}
+		if parent.Deleted {
+			sendError(client, currentRoom, CommentReply, "Comment has been deleted")
+			return
+		}
+		reply.ParentID = &parent.ID
+		reply.LineNumber = parent.LineNumber
+		reply.LineRange = parent.LineRange
+
+		// Set author from client user
+		if client, exists := room.Clients[clientID]; exists {
+			reply.Author = client.User.Name
+			reply.AuthorID = client.User.ID
+		}
 
-func handleCommentUpdate(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
-	// Similar implementation for comment updates
+		if err := store.SaveComment(currentRoom, reply); err != nil {
+			log.Printf("Error saving comment reply: %v", err)
+			return
+		}
+		room.Comments = append(room.Comments, reply)
+
+		broadcastToRoom(room, CommentMessage{
+			BaseMessage: BaseMessage{Type: CommentReply, Code: currentRoom},
+			Comment:     reply,
+		}, "")
+
+		notifyMentions(room, reply, nil)
+	})
 }
 
-func handleCommentDelete(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
+func handleCommentUpdate(client *Client, message []byte, currentRoom string, clientID string) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
 
 	var commentMsg CommentMessage
 	if err := json.Unmarshal(message, &commentMsg); err != nil {
-		log.Printf("Error unmarshaling comment delete message: %v", err)
+		log.Printf("Error unmarshaling comment update message: %v", err)
 		return
 	}
+	content := commentMsg.Comment.Content
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+
+	rooms.do(currentRoom, func(room *Room) {
+		for i, comment := range room.Comments {
+			if comment.ID != commentMsg.Comment.ID {
+				continue
+			}
+
+			// Only the author may edit a comment
+			if comment.Deleted {
+				sendError(client, currentRoom, CommentUpdate, "Comment has been deleted")
+				return
+			}
+			if client.User.ID == "" || client.User.ID != comment.AuthorID {
+				log.Printf("Client %s may not edit comment %s", clientID, comment.ID)
+				sendError(client, currentRoom, CommentUpdate, "Only the author can edit this comment")
+				return
+			}
+			if comment.Content == content {
+				return
+			}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
+			editedAt := time.Now()
+			if err := store.UpdateCommentContent(comment, content, editedAt); err != nil {
+				log.Printf("Error updating comment: %v", err)
+				return
+			}
 
-	if !exists {
+			// Users already mentioned before the edit aren't notified again
+			alreadyMentioned := findMentions(comment.Content, room.Members)
+			comment.Content = content
+			comment.EditedAt = &editedAt
+			room.Comments[i] = comment
+
+			// Broadcast the edited comment to all clients
+			broadcastToRoom(room, CommentMessage{
+				BaseMessage: BaseMessage{Type: CommentUpdate, Code: currentRoom},
+				Comment:     comment,
+			}, "")
+
+			notifyMentions(room, comment, alreadyMentioned)
+			return
+		}
+	})
+}
+
+func handleCommentDelete(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	// Allow anyone to delete comments - no authorization check needed
-
-	// Delete from database
-	if err := deleteComment(commentMsg.Comment.ID); err != nil {
-		log.Printf("Error deleting comment from database: %v", err)
+	var commentMsg CommentMessage
+	if err := json.Unmarshal(message, &commentMsg); err != nil {
+		log.Printf("Error unmarshaling comment delete message: %v", err)
 		return
 	}
 
-	// Remove from room
-	room.mutex.Lock()
-	for i, comment := range room.Comments {
-		if comment.ID == commentMsg.Comment.ID {
-			room.Comments = append(room.Comments[:i], room.Comments[i+1:]...)
-			break
+	rooms.do(currentRoom, func(room *Room) {
+		i := findComment(room.Comments, commentMsg.Comment.ID)
+		if i < 0 || room.Comments[i].Deleted {
+			return
 		}
-	}
-	room.mutex.Unlock()
+		comment := room.Comments[i]
+
+		// Authors may delete their own comments, owners and moderators any
+		userID := client.User.ID
+		if userID == "" || (userID != comment.AuthorID && !room.canModerate(userID)) {
+			log.Printf("Client %s may not delete comment %s", clientID, comment.ID)
+			sendError(client, currentRoom, CommentDelete, "Only the author or a moderator can delete this comment")
+			return
+		}
+
+		// Leave a tombstone in the database
+		deletedAt := time.Now()
+		if err := store.MarkCommentDeleted(comment.ID, userID, deletedAt); err != nil {
+			log.Printf("Error deleting comment from database: %v", err)
+			return
+		}
+
+		comment.Content = ""
+		comment.Reactions = nil
+		comment.Deleted = true
+		comment.DeletedBy = &userID
+		comment.DeletedAt = &deletedAt
+		room.Comments[i] = comment
+
+		// Broadcast to all clients
+		broadcastToRoom(room, CommentMessage{
+			BaseMessage: BaseMessage{Type: CommentDelete, Code: currentRoom},
+			Comment:     comment,
+		}, "")
+	})
+}
+
+func handleCommentResolve(client *Client, message []byte, currentRoom string, clientID string) {
+	setCommentResolved(client, message, currentRoom, clientID, true)
+}
 
-	// Broadcast to all clients
-	broadcastToRoom(room, commentMsg, "")
+func handleCommentReopen(client *Client, message []byte, currentRoom string, clientID string) {
+	setCommentResolved(client, message, currentRoom, clientID, false)
 }
 
-func handleUserActivity(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
+// setCommentResolved resolves or reopens the thread a comment belongs to.
+// Resolution is tracked on the thread's top-level comment.
+func setCommentResolved(client *Client, message []byte, currentRoom string, clientID string, resolved bool) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	var activityMsg UserActivityMessage
-	if err := json.Unmarshal(message, &activityMsg); err != nil {
-		log.Printf("Error unmarshaling user activity message: %v", err)
+	var commentMsg CommentMessage
+	if err := json.Unmarshal(message, &commentMsg); err != nil {
+		log.Printf("Error unmarshaling comment resolve message: %v", err)
 		return
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
+	rooms.do(currentRoom, func(room *Room) {
+		i := findComment(room.Comments, commentMsg.Comment.ID)
+		if i < 0 {
+			return
+		}
+		if parentID := room.Comments[i].ParentID; parentID != nil {
+			if j := findComment(room.Comments, *parentID); j >= 0 {
+				i = j
+			}
+		}
+		comment := room.Comments[i]
+		if comment.Resolved == resolved || comment.Deleted {
+			return
+		}
+
+		comment.Resolved = resolved
+		comment.ResolvedBy = nil
+		comment.ResolvedAt = nil
+		if resolved {
+			resolvedBy := client.User.ID
+			resolvedAt := time.Now()
+			comment.ResolvedBy = &resolvedBy
+			comment.ResolvedAt = &resolvedAt
+		}
+
+		if err := store.SetCommentResolved(comment.ID, comment.Resolved, comment.ResolvedBy, comment.ResolvedAt); err != nil {
+			log.Printf("Error updating comment resolution: %v", err)
+			return
+		}
+		room.Comments[i] = comment
+
+		msgType := CommentReopen
+		if resolved {
+			msgType = CommentResolve
+		}
+		broadcastToRoom(room, CommentMessage{
+			BaseMessage: BaseMessage{Type: msgType, Code: currentRoom},
+			Comment:     comment,
+		}, "")
+	})
+}
 
-	if !exists {
+func handleCommentReact(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	room.mutex.Lock()
-	if client, exists := room.Clients[clientID]; exists {
-		client.User.IsTyping = activityMsg.IsTyping
-		client.User.CurrentLine = activityMsg.CurrentLine
-		client.User.LastSeen = time.Now()
+	var reactMsg CommentReactMessage
+	if err := json.Unmarshal(message, &reactMsg); err != nil {
+		log.Printf("Error unmarshaling comment react message: %v", err)
+		return
+	}
+	if !validEmoji(reactMsg.Emoji) {
+		sendError(client, currentRoom, CommentReact, "Invalid reaction")
+		return
 	}
-	room.mutex.Unlock()
 
-	// Broadcast activity to others
-	broadcastToRoom(room, activityMsg, clientID)
+	rooms.do(currentRoom, func(room *Room) {
+		i := findComment(room.Comments, reactMsg.CommentID)
+		if i < 0 {
+			return
+		}
+		if room.Comments[i].Deleted {
+			sendError(client, currentRoom, CommentReact, "Comment has been deleted")
+			return
+		}
+
+		userID := client.User.ID
+		comment := &room.Comments[i]
+		previous := comment.Reactions
+		var err error
+		if reactMsg.Remove {
+			if !comment.removeReaction(userID, reactMsg.Emoji) {
+				return
+			}
+			err = store.RemoveCommentReaction(comment.ID, userID, reactMsg.Emoji)
+		} else {
+			if !comment.addReaction(userID, reactMsg.Emoji) {
+				return
+			}
+			err = store.AddCommentReaction(comment.ID, userID, reactMsg.Emoji)
+		}
+		if err != nil {
+			// The reaction methods copy on write, so the old list is intact
+			log.Printf("Error saving comment reaction: %v", err)
+			comment.Reactions = previous
+			sendError(client, currentRoom, CommentReact, "Could not save reaction")
+			return
+		}
+
+		broadcastToRoom(room, CommentReactMessage{
+			BaseMessage: BaseMessage{Type: CommentReact, Code: currentRoom},
+			CommentID:   comment.ID,
+			Emoji:       reactMsg.Emoji,
+			Remove:      reactMsg.Remove,
+			UserID:      userID,
+			Reactions:   comment.Reactions,
+		}, "")
+	})
 }
 
-func handleMediaUpload(conn *websocket.Conn, message []byte, currentRoom string, clientID string) {
+func handleCommentsSync(client *Client, message []byte, currentRoom string, clientID string) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	var mediaMsg MediaMessage
-	if err := json.Unmarshal(message, &mediaMsg); err != nil {
-		log.Printf("Error unmarshaling media upload message: %v", err)
+	var syncMsg CommentsMessage
+	if err := json.Unmarshal(message, &syncMsg); err != nil {
+		log.Printf("Error unmarshaling comments sync message: %v", err)
 		return
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
+	rooms.do(currentRoom, func(room *Room) {
+		client.send(commentsSyncMessage(room, syncMsg.HideResolved))
+	})
+}
 
-	if !exists {
+// handleMemberRole lets a room owner promote members to moderator or demote
+// them again.
+func handleMemberRole(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	// Set upload metadata from client user
-	room.mutex.RLock()
-	if client, exists := room.Clients[clientID]; exists {
-		mediaMsg.Media.UploadedBy = client.User.Name
+	var roleMsg MemberRoleMessage
+	if err := json.Unmarshal(message, &roleMsg); err != nil {
+		log.Printf("Error unmarshaling member role message: %v", err)
+		return
+	}
+	if roleMsg.Role != RoleModerator && roleMsg.Role != RoleMember {
+		sendError(client, currentRoom, MemberRoleType, "Role must be moderator or member")
+		return
 	}
-	room.mutex.RUnlock()
 
-	// Generate unique ID if not provided
-	if mediaMsg.Media.ID == "" {
-		mediaMsg.Media.ID = fmt.Sprintf("media_%d", time.Now().UnixNano())
+	rooms.do(currentRoom, func(room *Room) {
+		if owner, exists := room.Members[client.User.ID]; !exists || owner.Role != RoleOwner {
+			sendError(client, currentRoom, MemberRoleType, "Only the room owner can change roles")
+			return
+		}
+		member, exists := room.Members[roleMsg.UserID]
+		if !exists || member.Role == RoleOwner {
+			sendError(client, currentRoom, MemberRoleType, "Unknown member")
+			return
+		}
+		if member.Role == roleMsg.Role {
+			return
+		}
+
+		member.Role = roleMsg.Role
+		if err := store.SaveRoomMember(currentRoom, *member); err != nil {
+			log.Printf("Error saving member role: %v", err)
+			return
+		}
+		for _, c := range room.Clients {
+			if c.User.ID == member.UserID {
+				c.User.Role = member.Role
+			}
+		}
+
+		broadcastToRoom(room, MemberRoleMessage{
+			BaseMessage: BaseMessage{Type: MemberRoleType, Code: currentRoom},
+			UserID:      member.UserID,
+			Role:        member.Role,
+		}, "")
+	})
+}
+
+func handleUserActivity(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
 	}
 
-	// Save to database
-	if err := saveMediaFile(currentRoom, mediaMsg.Media); err != nil {
-		log.Printf("Error saving media file: %v", err)
+	var activityMsg UserActivityMessage
+	if err := json.Unmarshal(message, &activityMsg); err != nil {
+		log.Printf("Error unmarshaling user activity message: %v", err)
 		return
 	}
 
-	// Add to room
-	room.mutex.Lock()
-	room.MediaFiles = append(room.MediaFiles, mediaMsg.Media)
-	room.mutex.Unlock()
+	rooms.do(currentRoom, func(room *Room) {
+		client, exists := room.Clients[clientID]
+		if !exists {
+			return
+		}
+		client.User.IsTyping = activityMsg.IsTyping
+		client.User.CurrentLine = activityMsg.CurrentLine
+		client.User.LastSeen = time.Now()
 
-	// Broadcast to all clients
-	broadcastToRoom(room, mediaMsg, "")
+		if activityMsg.Selections != nil {
+			revision := room.Revision
+			if activityMsg.Revision != nil {
+				revision = *activityMsg.Revision
+			}
+			selections, ok := room.rebaseSelections(clientID, activityMsg.Selections, revision)
+			if !ok {
+				log.Printf("Dropping selections from client %s at unknown revision %d", clientID, revision)
+			}
+			client.User.Selections = selections
+		}
+		revision := room.Revision
+		activityMsg.UserID = client.User.ID
+		activityMsg.Selections = client.User.Selections
+		activityMsg.Revision = &revision
+
+		// Broadcast activity to others
+		broadcastToRoom(room, activityMsg, clientID)
+	})
 }
 
-func handleMediaDelete(_ *websocket.Conn, message []byte, currentRoom string, clientID string) {
+func handleMediaUpload(client *Client, message []byte, currentRoom string, clientID string) {
 	if currentRoom == "" || clientID == "" {
 		return
 	}
 
 	var mediaMsg MediaMessage
 	if err := json.Unmarshal(message, &mediaMsg); err != nil {
-		log.Printf("Error unmarshaling media delete message: %v", err)
+		log.Printf("Error unmarshaling media upload message: %v", err)
 		return
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[currentRoom]
-	roomsMutex.RUnlock()
+	// Always generate the ID, so media announced here can't pass for a file
+	// uploaded over HTTP and have deleting it remove something on disk
+	mediaMsg.Media.ID = fmt.Sprintf("media_%d", time.Now().UnixNano())
+
+	rooms.do(currentRoom, func(room *Room) {
+		// Set upload metadata from client user
+		if client, exists := room.Clients[clientID]; exists {
+			mediaMsg.Media.UploadedBy = client.User.Name
+		}
+
+		// Save to database
+		if err := store.SaveMediaFile(currentRoom, mediaMsg.Media); err != nil {
+			log.Printf("Error saving media file: %v", err)
+			return
+		}
+
+		// Add to room
+		room.MediaFiles = append(room.MediaFiles, mediaMsg.Media)
 
-	if !exists {
+		// Broadcast to all clients
+		broadcastToRoom(room, mediaMsg, "")
+	})
+}
+
+func handleMediaDelete(_ *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
 		return
 	}
 
-	// Remove from database
-	if err := deleteMediaFile(mediaMsg.Media.ID); err != nil {
-		log.Printf("Error deleting media file: %v", err)
+	var mediaMsg MediaMessage
+	if err := json.Unmarshal(message, &mediaMsg); err != nil {
+		log.Printf("Error unmarshaling media delete message: %v", err)
 		return
 	}
 
-	// Remove from room
-	room.mutex.Lock()
+	rooms.do(currentRoom, func(room *Room) {
+		// Remove from database
+		media, err := store.GetMediaFile(currentRoom, mediaMsg.Media.ID)
+		if err == nil {
+			err = deleteMediaFile(currentRoom, media)
+		}
+		if err != nil {
+			log.Printf("Error deleting media file: %v", err)
+			return
+		}
+
+		// Remove from room
+		removeRoomMedia(room, mediaMsg.Media.ID)
+
+		// Broadcast to all clients
+		broadcastToRoom(room, mediaMsg, "")
+	})
+}
+
+func removeRoomMedia(room *Room, mediaID string) {
 	for i, media := range room.MediaFiles {
-		if media.ID == mediaMsg.Media.ID {
+		if media.ID == mediaID {
 			room.MediaFiles = append(room.MediaFiles[:i], room.MediaFiles[i+1:]...)
 			break
 		}
 	}
-	room.mutex.Unlock()
-
-	// Broadcast to all clients
-	broadcastToRoom(room, mediaMsg, "")
 }
 
 func leaveRoom(roomCode string, clientID string) {
-	roomsMutex.Lock()
-	defer roomsMutex.Unlock()
-
-	if room, exists := rooms[roomCode]; exists {
-		room.mutex.Lock()
+	rooms.call(roomCode, func(room *Room) {
 		if client, exists := room.Clients[clientID]; exists {
 			delete(room.Clients, clientID)
 
@@ -1120,18 +2192,24 @@ func leaveRoom(roomCode string, clientID string) {
 			broadcastToRoom(room, userLeftMsg, "")
 		}
 
-		clientCount := len(room.Clients)
-		room.mutex.Unlock()
-
-		if clientCount == 0 && time.Since(room.CreatedAt) > 24*time.Hour {
-			deleteRoomContent(roomCode)
-			deleteRoomComments(roomCode)
-			deleteRoomMedia(roomCode)
-			delete(rooms, roomCode)
+		if len(room.Clients) == 0 && time.Since(room.CreatedAt) > 24*time.Hour {
+			room.markContentClean()
+			store.DeleteRoomContent(roomCode)
+			store.DeleteRoomRevisions(roomCode)
+			store.DeleteRoomComments(roomCode)
+			deleteRoomMediaFiles(roomCode)
+			store.DeleteRoomMembers(roomCode)
+			store.DeleteRoomUploads(roomCode)
+			store.DeleteRoomChat(roomCode)
+			store.DeleteRoomMentions(roomCode)
+			removeRoomDir(roomCode)
+			room.retire()
 			log.Printf("Room %s deleted (no clients remaining and older than 1 day)", roomCode)
+		} else if len(room.Clients) == 0 {
+			room.flushContentLogged()
 		}
 		log.Printf("Client %s left room %s", clientID, roomCode)
-	}
+	})
 }
 
 func handleClientDisconnection(currentRoom string, clientID string) {
@@ -1140,105 +2218,3 @@ func handleClientDisconnection(currentRoom string, clientID string) {
 	}
 	log.Printf("Client %s disconnected", clientID)
 }
-
-func saveRoomContent(code, content string) error {
-	_, err := db.Exec("INSERT OR REPLACE INTO rooms (code, content) VALUES (?, ?)", code, content)
-	return err
-}
-
-func getRoomContent(code string) (string, error) {
-	var content string
-	err := db.QueryRow("SELECT content FROM rooms WHERE code = ?", code).Scan(&content)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", nil
-		}
-		return "", err
-	}
-	return content, nil
-}
-
-func deleteRoomContent(code string) error {
-	_, err := db.Exec("DELETE FROM rooms WHERE code = ?", code)
-	return err
-}
-
-func saveComment(roomCode string, comment Comment) error {
-	_, err := db.Exec(`INSERT INTO comments (id, room_code, line_number, line_range, author, author_id, content, timestamp) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		comment.ID, roomCode, comment.LineNumber, comment.LineRange,
-		comment.Author, comment.AuthorID, comment.Content, comment.Timestamp)
-	return err
-}
-
-func deleteComment(commentID string) error {
-	_, err := db.Exec(`DELETE FROM comments WHERE id = ?`, commentID)
-	return err
-}
-
-func getRoomComments(roomCode string) ([]Comment, error) {
-	rows, err := db.Query(`SELECT id, line_number, line_range, author, author_id, content, timestamp 
-		FROM comments WHERE room_code = ? ORDER BY timestamp ASC`, roomCode)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var comments []Comment
-	for rows.Next() {
-		var comment Comment
-		err := rows.Scan(&comment.ID, &comment.LineNumber, &comment.LineRange,
-			&comment.Author, &comment.AuthorID, &comment.Content, &comment.Timestamp)
-		if err != nil {
-			log.Printf("Error scanning comment: %v", err)
-			continue
-		}
-		comments = append(comments, comment)
-	}
-	return comments, nil
-}
-
-func deleteRoomComments(roomCode string) error {
-	_, err := db.Exec("DELETE FROM comments WHERE room_code = ?", roomCode)
-	return err
-}
-
-func getRoomMedia(roomCode string) ([]MediaFile, error) {
-	rows, err := db.Query(`SELECT id, name, type, size, url, uploaded_at, uploaded_by 
-		FROM media_files WHERE room_code = ? ORDER BY uploaded_at ASC`, roomCode)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var mediaFiles []MediaFile
-	for rows.Next() {
-		var media MediaFile
-		err := rows.Scan(&media.ID, &media.Name, &media.Type, &media.Size,
-			&media.URL, &media.UploadedAt, &media.UploadedBy)
-		if err != nil {
-			log.Printf("Error scanning media file: %v", err)
-			continue
-		}
-		mediaFiles = append(mediaFiles, media)
-	}
-	return mediaFiles, nil
-}
-
-func deleteRoomMedia(roomCode string) error {
-	_, err := db.Exec("DELETE FROM media_files WHERE room_code = ?", roomCode)
-	return err
-}
-
-func saveMediaFile(roomCode string, media MediaFile) error {
-	_, err := db.Exec(`INSERT INTO media_files (id, room_code, name, type, size, url, uploaded_at, uploaded_by) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		media.ID, roomCode, media.Name, media.Type, media.Size,
-		media.URL, media.UploadedAt, media.UploadedBy)
-	return err
-}
-
-func deleteMediaFile(mediaID string) error {
-	_, err := db.Exec("DELETE FROM media_files WHERE id = ?", mediaID)
-	return err
-}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type MemberRole string
+
+const (
+	RoleOwner     MemberRole = "owner"
+	RoleModerator MemberRole = "moderator"
+	RoleMember    MemberRole = "member"
+)
+
+// RoomMember is a user who has joined a room at some point.
+type RoomMember struct {
+	UserID   string     `json:"userId"`
+	Name     string     `json:"name"`
+	Role     MemberRole `json:"role"`
+	JoinedAt time.Time  `json:"joinedAt"`
+}
+
+// addMember records user as a member of the room, making the first user to
+// join its owner, and returns the user's role.
+func (room *Room) addMember(user User) MemberRole {
+	member, exists := room.Members[user.ID]
+	if exists && member.Name == user.Name {
+		return member.Role
+	}
+	if !exists {
+		member = &RoomMember{UserID: user.ID, Role: RoleMember, JoinedAt: time.Now()}
+		if len(room.Members) == 0 {
+			member.Role = RoleOwner
+		}
+		room.Members[user.ID] = member
+	}
+	member.Name = user.Name
+
+	if err := store.SaveRoomMember(room.Code, *member); err != nil {
+		log.Printf("Error saving member %s of room %s: %v", user.ID, room.Code, err)
+	}
+	return member.Role
+}
+
+// canModerate reports whether userID may act on other users' comments.
+func (room *Room) canModerate(userID string) bool {
+	member, exists := room.Members[userID]
+	return exists && (member.Role == RoleOwner || member.Role == RoleModerator)
+}
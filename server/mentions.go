@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Characters of the comment kept with a mention.
+const mentionExcerptLength = 200
+
+// Mention records that a comment in RoomCode @-mentioned a user.
+type Mention struct {
+	ID        string    `json:"id"`
+	RoomCode  string    `json:"roomCode"`
+	CommentID string    `json:"commentId"`
+	Author    string    `json:"author"`
+	AuthorID  string    `json:"authorId"`
+	Excerpt   string    `json:"excerpt"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// userConnections tracks every connected client by user ID so mentions reach
+// a user in whichever room they currently have open.
+type userConnections struct {
+	mutex   sync.Mutex
+	clients map[string]map[*Client]bool
+	users   map[*Client]string
+}
+
+var connections = &userConnections{
+	clients: make(map[string]map[*Client]bool),
+	users:   make(map[*Client]string),
+}
+
+func (uc *userConnections) add(userID string, client *Client) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	uc.removeLocked(client)
+	if uc.clients[userID] == nil {
+		uc.clients[userID] = make(map[*Client]bool)
+	}
+	uc.clients[userID][client] = true
+	uc.users[client] = userID
+}
+
+func (uc *userConnections) remove(client *Client) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	uc.removeLocked(client)
+}
+
+func (uc *userConnections) removeLocked(client *Client) {
+	userID, exists := uc.users[client]
+	if !exists {
+		return
+	}
+	delete(uc.users, client)
+	delete(uc.clients[userID], client)
+	if len(uc.clients[userID]) == 0 {
+		delete(uc.clients, userID)
+	}
+}
+
+// send queues message for every connection of userID.
+func (uc *userConnections) send(userID string, message interface{}) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	for client := range uc.clients[userID] {
+		client.send(message)
+	}
+}
+
+func isNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+// findMentions returns the IDs of room members whose name appears in content
+// as @Name, ignoring case. Longer names are matched first so that "@Red Cat"
+// doesn't also count as a mention of a member called "Red".
+func findMentions(content string, members map[string]*RoomMember) []string {
+	if !strings.Contains(content, "@") {
+		return nil
+	}
+
+	byLength := make([]*RoomMember, 0, len(members))
+	for _, member := range members {
+		if member.Name != "" {
+			byLength = append(byLength, member)
+		}
+	}
+	sort.Slice(byLength, func(i, j int) bool {
+		return len(byLength[i].Name) > len(byLength[j].Name)
+	})
+
+	lower := strings.ToLower(content)
+	claimed := make([]bool, len(lower))
+	var userIDs []string
+	for _, member := range byLength {
+		needle := "@" + strings.ToLower(member.Name)
+		found := false
+		for start := 0; !found; {
+			i := strings.Index(lower[start:], needle)
+			if i < 0 {
+				break
+			}
+			i += start
+			end := i + len(needle)
+			start = i + 1
+
+			before, _ := utf8.DecodeLastRuneInString(lower[:i])
+			after, _ := utf8.DecodeRuneInString(lower[end:])
+			if claimed[i] || (i > 0 && isNameChar(before)) || (end < len(lower) && isNameChar(after)) {
+				continue
+			}
+			for j := i; j < end; j++ {
+				claimed[j] = true
+			}
+			found = true
+		}
+		if found {
+			userIDs = append(userIDs, member.UserID)
+		}
+	}
+	return userIDs
+}
+
+// notifyMentions records a mention for every member named in comment except
+// its author and those in skip, and pushes it to their open connections.
+func notifyMentions(room *Room, comment Comment, skip []string) {
+	excerpt := comment.Content
+	if utf8.RuneCountInString(excerpt) > mentionExcerptLength {
+		excerpt = string([]rune(excerpt)[:mentionExcerptLength]) + "…"
+	}
+
+	for _, userID := range findMentions(comment.Content, room.Members) {
+		if userID == comment.AuthorID || contains(skip, userID) {
+			continue
+		}
+
+		mention := Mention{
+			ID:        fmt.Sprintf("mention_%d", time.Now().UnixNano()),
+			RoomCode:  room.Code,
+			CommentID: comment.ID,
+			Author:    comment.Author,
+			AuthorID:  comment.AuthorID,
+			Excerpt:   excerpt,
+			Timestamp: time.Now(),
+		}
+		if err := store.SaveMention(userID, mention); err != nil {
+			log.Printf("Error saving mention of %s: %v", userID, err)
+			continue
+		}
+		connections.send(userID, MentionMessage{
+			BaseMessage: BaseMessage{Type: MentionType, Code: room.Code},
+			Mention:     mention,
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sendMentionInbox(client *Client, roomCode, userID string) {
+	mentions, err := store.GetUnreadMentions(userID)
+	if err != nil {
+		log.Printf("Error loading mentions for %s: %v", userID, err)
+		return
+	}
+	client.send(MentionInboxMessage{
+		BaseMessage: BaseMessage{Type: MentionInbox, Code: roomCode},
+		Mentions:    mentions,
+	})
+}
+
+func handleMentionsRead(client *Client, message []byte, currentRoom string, clientID string) {
+	if currentRoom == "" || clientID == "" {
+		return
+	}
+
+	var readMsg MentionsReadMessage
+	if err := json.Unmarshal(message, &readMsg); err != nil {
+		log.Printf("Error unmarshaling mentions read message: %v", err)
+		return
+	}
+
+	userID := client.User.ID
+	if err := store.MarkMentionsRead(userID, readMsg.IDs, time.Now()); err != nil {
+		log.Printf("Error marking mentions read for %s: %v", userID, err)
+		return
+	}
+
+	// Bring the user's other connections up to date as well
+	mentions, err := store.GetUnreadMentions(userID)
+	if err != nil {
+		log.Printf("Error loading mentions for %s: %v", userID, err)
+		return
+	}
+	connections.send(userID, MentionInboxMessage{
+		BaseMessage: BaseMessage{Type: MentionInbox, Code: currentRoom},
+		Mentions:    mentions,
+	})
+}
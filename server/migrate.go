@@ -0,0 +1,270 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/<dialect>/ as NNNN_name.up.sql and
+// NNNN_name.down.sql and are applied in version order. Never edit a migration
+// that has shipped; add a new one instead.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// sqliteFTS5Migrations need SQLite's FTS5 module. A build without it records
+// them as applied without running them, and setupSearchIndex creates what
+// they would have once a build with FTS5 starts.
+var sqliteFTS5Migrations = map[int]bool{
+	10: true,
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		versionStr, label, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("bad version in migration file %s", entry.Name())
+		}
+
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (s *sqlStore) ensureMigrationsTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+func (s *sqlStore) appliedMigrations() (map[int]time.Time, error) {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// MigrateUp applies every pending migration, each in its own transaction, and
+// returns the ones it applied.
+func (s *sqlStore) MigrateUp() ([]Migration, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := s.runMigration(s.migrationScript(m, m.Up), "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+			return ran, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, s.setupSearchIndex()
+}
+
+// MigrateDown reverts the most recently applied migration. It returns nil if
+// there was nothing to revert.
+func (s *sqlStore) MigrateDown() (*Migration, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s cannot be reverted", m.Version, m.Name)
+		}
+		if err := s.runMigration(s.migrationScript(m, m.Down), "DELETE FROM schema_migrations WHERE version = ?", m.Version); err != nil {
+			return nil, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		return &m, nil
+	}
+	return nil, nil
+}
+
+func (s *sqlStore) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i].Migration = m
+		if appliedAt, ok := applied[m.Version]; ok {
+			status[i].AppliedAt = &appliedAt
+		}
+	}
+	return status, nil
+}
+
+// migrationScript returns script, one of m's, or nothing if this database
+// can't run m.
+func (s *sqlStore) migrationScript(m Migration, script string) string {
+	if s.dialect == "sqlite" && !s.fts5 && sqliteFTS5Migrations[m.Version] {
+		log.Printf("Skipping migration %04d_%s, which needs FTS5", m.Version, m.Name)
+		return ""
+	}
+	return script
+}
+
+// runMigration executes a migration script and records it in
+// schema_migrations within one transaction.
+func (s *sqlStore) runMigration(script, record string, args ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if script != "" {
+		if _, err := tx.Exec(script); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(s.q(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrateCommand implements `server migrate up|down|status`.
+func runMigrateCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: server migrate up|down|status")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "up":
+		ran, err := store.MigrateUp()
+		for _, m := range ran {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		if len(ran) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+	case "down":
+		m, err := store.MigrateDown()
+		if err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		if m == nil {
+			fmt.Println("No migrations to revert")
+		} else {
+			fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+		}
+	case "status":
+		status, err := store.MigrationStatus()
+		if err != nil {
+			log.Fatal("Failed to read migration status: ", err)
+		}
+		for _, m := range status {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-24s %s\n", m.Version, m.Name, state)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		os.Exit(2)
+	}
+}
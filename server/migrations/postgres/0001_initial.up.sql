@@ -0,0 +1,52 @@
+-- Baseline schema. IF NOT EXISTS lets databases created before migrations
+-- were introduced adopt it without changes.
+--
+-- Unlike SQLite, PostgreSQL enforces foreign keys, and comments, media and
+-- revisions can all be written before a room's content is first saved, so
+-- room_code is left unconstrained here.
+
+CREATE TABLE IF NOT EXISTS rooms (
+	code TEXT PRIMARY KEY,
+	content TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+	id TEXT PRIMARY KEY,
+	room_code TEXT,
+	line_number INTEGER,
+	line_range TEXT,
+	author TEXT,
+	author_id TEXT,
+	content TEXT,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS comments_room_code ON comments (room_code);
+
+CREATE TABLE IF NOT EXISTS media_files (
+	id TEXT PRIMARY KEY,
+	room_code TEXT,
+	name TEXT,
+	type TEXT,
+	size BIGINT,
+	url TEXT,
+	uploaded_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	uploaded_by TEXT
+);
+
+CREATE INDEX IF NOT EXISTS media_files_room_code ON media_files (room_code);
+
+CREATE TABLE IF NOT EXISTS room_crdt (
+	room_code TEXT PRIMARY KEY,
+	state BYTEA
+);
+
+CREATE TABLE IF NOT EXISTS room_revisions (
+	room_code TEXT,
+	number INTEGER,
+	author_id TEXT,
+	content TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(room_code, number)
+);
@@ -0,0 +1,11 @@
+ALTER TABLE comments ADD COLUMN edited_at TIMESTAMPTZ;
+
+-- Earlier contents of edited comments, numbered from 1 for the original text.
+CREATE TABLE IF NOT EXISTS comment_versions (
+	comment_id TEXT,
+	version INTEGER,
+	content TEXT,
+	created_at TIMESTAMPTZ,
+	PRIMARY KEY(comment_id, version),
+	FOREIGN KEY(comment_id) REFERENCES comments(id)
+);
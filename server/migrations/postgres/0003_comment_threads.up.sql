@@ -0,0 +1,4 @@
+-- Replies point at the comment that starts their thread.
+ALTER TABLE comments ADD COLUMN parent_id TEXT REFERENCES comments(id);
+
+CREATE INDEX IF NOT EXISTS comments_parent_id ON comments (parent_id);
@@ -0,0 +1,3 @@
+ALTER TABLE comments ADD COLUMN resolved BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE comments ADD COLUMN resolved_by TEXT;
+ALTER TABLE comments ADD COLUMN resolved_at TIMESTAMPTZ;
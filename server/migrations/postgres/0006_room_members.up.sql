@@ -0,0 +1,9 @@
+-- Everyone who has joined a room. The first user to join becomes its owner.
+CREATE TABLE IF NOT EXISTS room_members (
+	room_code TEXT,
+	user_id TEXT,
+	name TEXT,
+	role TEXT NOT NULL DEFAULT 'member',
+	joined_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(room_code, user_id)
+);
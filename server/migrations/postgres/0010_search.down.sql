@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS comments_content_search;
+DROP INDEX IF EXISTS rooms_content_search;
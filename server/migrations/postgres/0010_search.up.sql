@@ -0,0 +1,7 @@
+-- Full-text indexes over room content and comments. The expressions must
+-- match the ones used by Search for the planner to pick these up.
+CREATE INDEX IF NOT EXISTS rooms_content_search ON rooms
+	USING GIN (to_tsvector('simple', coalesce(content, '')));
+
+CREATE INDEX IF NOT EXISTS comments_content_search ON comments
+	USING GIN (to_tsvector('simple', coalesce(content, '')));
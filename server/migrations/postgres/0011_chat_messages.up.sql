@@ -0,0 +1,11 @@
+-- Room chat, numbered per room so history can be paged backwards.
+CREATE TABLE IF NOT EXISTS chat_messages (
+	room_code TEXT,
+	number INTEGER,
+	id TEXT,
+	author TEXT,
+	author_id TEXT,
+	content TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(room_code, number)
+);
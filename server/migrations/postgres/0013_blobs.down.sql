@@ -0,0 +1,4 @@
+-- Older versions can't find files in the blob store, so forget them.
+DELETE FROM media_files WHERE blob_hash IS NOT NULL;
+ALTER TABLE media_files DROP COLUMN blob_hash;
+DROP TABLE IF EXISTS blobs;
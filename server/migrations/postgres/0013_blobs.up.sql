@@ -0,0 +1,11 @@
+-- Uploaded files are stored once per distinct content, named by SHA-256 and
+-- shared by every media_files row with the same blob_hash. Rows from before
+-- this migration have no blob and keep their file in the room directory.
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	size BIGINT,
+	ref_count INTEGER,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE media_files ADD COLUMN blob_hash TEXT;
@@ -0,0 +1,3 @@
+ALTER TABLE media_files DROP COLUMN height;
+ALTER TABLE media_files DROP COLUMN width;
+ALTER TABLE media_files DROP COLUMN thumbnail_url;
@@ -0,0 +1,5 @@
+-- Image dimensions and thumbnail, filled in by the thumbnail worker after
+-- upload.
+ALTER TABLE media_files ADD COLUMN thumbnail_url TEXT;
+ALTER TABLE media_files ADD COLUMN width INTEGER;
+ALTER TABLE media_files ADD COLUMN height INTEGER;
@@ -0,0 +1,7 @@
+-- Tokens proving a client may use a user ID, stored as SHA-256 hashes. The
+-- first client to join with an ID is issued its token.
+CREATE TABLE IF NOT EXISTS user_tokens (
+	user_id TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+ALTER TABLE room_revisions DROP COLUMN updated_at;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS room_revisions;
+DROP TABLE IF EXISTS room_crdt;
+DROP TABLE IF EXISTS media_files;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS rooms;
@@ -0,0 +1,50 @@
+-- Baseline schema. IF NOT EXISTS lets databases created before migrations
+-- were introduced adopt it without changes.
+
+CREATE TABLE IF NOT EXISTS rooms (
+	code TEXT PRIMARY KEY,
+	content TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+	id TEXT PRIMARY KEY,
+	room_code TEXT,
+	line_number INTEGER,
+	line_range TEXT,
+	author TEXT,
+	author_id TEXT,
+	content TEXT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(room_code) REFERENCES rooms(code)
+);
+
+CREATE TABLE IF NOT EXISTS media_files (
+	id TEXT PRIMARY KEY,
+	room_code TEXT,
+	name TEXT,
+	type TEXT,
+	size INTEGER,
+	url TEXT,
+	uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	uploaded_by TEXT,
+	FOREIGN KEY(room_code) REFERENCES rooms(code)
+);
+
+-- CRDT state lives next to rooms.content and is written in the same
+-- transaction, see SaveRoomContent.
+CREATE TABLE IF NOT EXISTS room_crdt (
+	room_code TEXT PRIMARY KEY,
+	state BLOB,
+	FOREIGN KEY(room_code) REFERENCES rooms(code)
+);
+
+CREATE TABLE IF NOT EXISTS room_revisions (
+	room_code TEXT,
+	number INTEGER,
+	author_id TEXT,
+	content TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(room_code, number),
+	FOREIGN KEY(room_code) REFERENCES rooms(code)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS comment_versions;
+
+ALTER TABLE comments DROP COLUMN edited_at;
@@ -0,0 +1,2 @@
+-- Replies point at the comment that starts their thread.
+ALTER TABLE comments ADD COLUMN parent_id TEXT REFERENCES comments(id);
@@ -0,0 +1,3 @@
+ALTER TABLE comments DROP COLUMN resolved_at;
+ALTER TABLE comments DROP COLUMN resolved_by;
+ALTER TABLE comments DROP COLUMN resolved;
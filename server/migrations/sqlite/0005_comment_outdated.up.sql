@@ -0,0 +1,2 @@
+-- Set once the lines a comment was anchored to have been deleted.
+ALTER TABLE comments ADD COLUMN outdated BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+-- Everyone who has joined a room. The first user to join becomes its owner.
+CREATE TABLE IF NOT EXISTS room_members (
+	room_code TEXT,
+	user_id TEXT,
+	name TEXT,
+	role TEXT NOT NULL DEFAULT 'member',
+	joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(room_code, user_id),
+	FOREIGN KEY(room_code) REFERENCES rooms(code)
+);
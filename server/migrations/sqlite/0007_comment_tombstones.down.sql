@@ -0,0 +1,9 @@
+-- Replies to deleted comments become top-level comments again.
+UPDATE comments SET parent_id = NULL
+	WHERE parent_id IN (SELECT id FROM comments WHERE deleted_at IS NOT NULL);
+DELETE FROM comment_versions
+	WHERE comment_id IN (SELECT id FROM comments WHERE deleted_at IS NOT NULL);
+DELETE FROM comments WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE comments DROP COLUMN deleted_at;
+ALTER TABLE comments DROP COLUMN deleted_by;
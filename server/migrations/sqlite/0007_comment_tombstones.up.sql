@@ -0,0 +1,3 @@
+-- Deleted comments stay behind as tombstones so their replies keep a parent.
+ALTER TABLE comments ADD COLUMN deleted_by TEXT;
+ALTER TABLE comments ADD COLUMN deleted_at DATETIME;
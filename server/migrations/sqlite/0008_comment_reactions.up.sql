@@ -0,0 +1,9 @@
+-- One row per user and emoji on a comment.
+CREATE TABLE IF NOT EXISTS comment_reactions (
+	comment_id TEXT,
+	user_id TEXT,
+	emoji TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(comment_id, user_id, emoji),
+	FOREIGN KEY(comment_id) REFERENCES comments(id)
+);
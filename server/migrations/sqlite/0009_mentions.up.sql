@@ -0,0 +1,14 @@
+-- @mentions in comments, kept per mentioned user until read.
+CREATE TABLE IF NOT EXISTS mentions (
+	id TEXT PRIMARY KEY,
+	user_id TEXT,
+	room_code TEXT,
+	comment_id TEXT,
+	author TEXT,
+	author_id TEXT,
+	excerpt TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	read_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS mentions_user_id ON mentions (user_id, read_at);
@@ -0,0 +1,9 @@
+DROP TRIGGER IF EXISTS comments_fts_update;
+DROP TRIGGER IF EXISTS comments_fts_delete;
+DROP TRIGGER IF EXISTS comments_fts_insert;
+DROP TABLE IF EXISTS comments_fts;
+
+DROP TRIGGER IF EXISTS rooms_fts_update;
+DROP TRIGGER IF EXISTS rooms_fts_delete;
+DROP TRIGGER IF EXISTS rooms_fts_insert;
+DROP TABLE IF EXISTS rooms_fts;
@@ -0,0 +1,30 @@
+-- Full-text indexes over room content and comments, kept in step with their
+-- tables by triggers. Requires SQLite built with FTS5 (-tags sqlite_fts5).
+CREATE VIRTUAL TABLE IF NOT EXISTS rooms_fts USING fts5(content, content='rooms', content_rowid='rowid');
+
+CREATE TRIGGER IF NOT EXISTS rooms_fts_insert AFTER INSERT ON rooms BEGIN
+	INSERT INTO rooms_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS rooms_fts_delete AFTER DELETE ON rooms BEGIN
+	INSERT INTO rooms_fts (rooms_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS rooms_fts_update AFTER UPDATE OF content ON rooms BEGIN
+	INSERT INTO rooms_fts (rooms_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+	INSERT INTO rooms_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+
+CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(content, content='comments', content_rowid='rowid');
+
+CREATE TRIGGER IF NOT EXISTS comments_fts_insert AFTER INSERT ON comments BEGIN
+	INSERT INTO comments_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS comments_fts_delete AFTER DELETE ON comments BEGIN
+	INSERT INTO comments_fts (comments_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS comments_fts_update AFTER UPDATE OF content ON comments BEGIN
+	INSERT INTO comments_fts (comments_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+	INSERT INTO comments_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+
+INSERT INTO rooms_fts (rooms_fts) VALUES ('rebuild');
+INSERT INTO comments_fts (comments_fts) VALUES ('rebuild');
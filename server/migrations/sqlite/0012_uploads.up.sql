@@ -0,0 +1,13 @@
+-- Resumable uploads in progress. The partial file lives in the room
+-- directory as <filename>.part until upload_offset reaches upload_length.
+CREATE TABLE IF NOT EXISTS uploads (
+	id TEXT PRIMARY KEY,
+	room_code TEXT,
+	name TEXT,
+	type TEXT,
+	uploaded_by TEXT,
+	filename TEXT,
+	upload_length INTEGER,
+	upload_offset INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+-- When a revision last took in an edit. Coalescing is timed from this rather
+-- than created_at, so a revision keeps growing while its author keeps typing.
+ALTER TABLE room_revisions ADD COLUMN updated_at DATETIME;
+UPDATE room_revisions SET updated_at = created_at;
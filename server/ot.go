@@ -0,0 +1,188 @@
+package main
+
+import (
+	"unicode/utf16"
+)
+
+type TextOpType string
+
+const (
+	OpInsert TextOpType = "insert"
+	OpDelete TextOpType = "delete"
+)
+
+// TextOp is a single insert or delete against a document. Positions and
+// lengths are measured in UTF-16 code units so they line up with JavaScript
+// string indices on the client.
+type TextOp struct {
+	Type   TextOpType `json:"type"`
+	Pos    int        `json:"pos"`
+	Text   string     `json:"text,omitempty"`
+	Length int        `json:"length,omitempty"`
+}
+
+// textOpsRecord is an entry in a room's operation log: the ops that moved the
+// document from Revision-1 to Revision.
+type textOpsRecord struct {
+	Revision int
+	ClientID string
+	Ops      []TextOp
+}
+
+// Number of applied revisions kept per room for transforming late ops.
+const maxOpLogSize = 1000
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func (op TextOp) size() int {
+	if op.Type == OpInsert {
+		return utf16Len(op.Text)
+	}
+	return op.Length
+}
+
+func (op TextOp) isNoop() bool {
+	return op.size() == 0
+}
+
+// splitsSurrogatePair reports whether pos falls between the two halves of a
+// surrogate pair in units.
+func splitsSurrogatePair(units []uint16, pos int) bool {
+	return pos > 0 && pos < len(units) &&
+		units[pos-1] >= 0xd800 && units[pos-1] < 0xdc00 &&
+		units[pos] >= 0xdc00 && units[pos] < 0xe000
+}
+
+// applyOps applies ops in order to content. Each op is positioned relative to
+// the document produced by the ops before it. Ops that would split a
+// surrogate pair are rejected, since the result would not be valid UTF-16.
+func applyOps(content string, ops []TextOp) (string, bool) {
+	units := utf16.Encode([]rune(content))
+	for _, op := range ops {
+		if op.Pos < 0 || op.Pos > len(units) || splitsSurrogatePair(units, op.Pos) {
+			return content, false
+		}
+		switch op.Type {
+		case OpInsert:
+			text := utf16.Encode([]rune(op.Text))
+			next := make([]uint16, 0, len(units)+len(text))
+			next = append(next, units[:op.Pos]...)
+			next = append(next, text...)
+			units = append(next, units[op.Pos:]...)
+		case OpDelete:
+			if op.Length < 0 || op.Pos+op.Length > len(units) || splitsSurrogatePair(units, op.Pos+op.Length) {
+				return content, false
+			}
+			units = append(units[:op.Pos], units[op.Pos+op.Length:]...)
+		default:
+			return content, false
+		}
+	}
+	return string(utf16.Decode(units)), true
+}
+
+// transformOp rebases a so that it applies after b. When both insert at the
+// same position, winsTie decides whether a ends up before b's text.
+func transformOp(a, b TextOp, winsTie bool) []TextOp {
+	switch {
+	case a.Type == OpInsert && b.Type == OpInsert:
+		if b.Pos < a.Pos || (b.Pos == a.Pos && !winsTie) {
+			a.Pos += b.size()
+		}
+	case a.Type == OpInsert && b.Type == OpDelete:
+		if a.Pos >= b.Pos+b.Length {
+			a.Pos -= b.Length
+		} else if a.Pos > b.Pos {
+			a.Pos = b.Pos
+		}
+	case a.Type == OpDelete && b.Type == OpInsert:
+		if b.Pos <= a.Pos {
+			a.Pos += b.size()
+		} else if b.Pos < a.Pos+a.Length {
+			// The insert lands inside the deleted range, so the delete is
+			// split around the inserted text.
+			before := TextOp{Type: OpDelete, Pos: a.Pos, Length: b.Pos - a.Pos}
+			after := TextOp{Type: OpDelete, Pos: a.Pos + b.size(), Length: a.Length - before.Length}
+			return []TextOp{before, after}
+		}
+	case a.Type == OpDelete && b.Type == OpDelete:
+		aEnd, bEnd := a.Pos+a.Length, b.Pos+b.Length
+		if aEnd <= b.Pos {
+			break
+		}
+		if a.Pos >= bEnd {
+			a.Pos -= b.Length
+			break
+		}
+		overlap := min(aEnd, bEnd) - max(a.Pos, b.Pos)
+		a.Pos = min(a.Pos, b.Pos)
+		a.Length -= overlap
+	}
+	if a.isNoop() {
+		return nil
+	}
+	return []TextOp{a}
+}
+
+// transformOps rebases the incoming ops a over the already applied ops b and
+// returns both a' (to apply after b) and b' (to apply after a). Ops already
+// applied by the server win ties.
+func transformOps(a, b []TextOp) ([]TextOp, []TextOp) {
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+	if len(a) > 1 {
+		head, b1 := transformOps(a[:1], b)
+		tail, b2 := transformOps(a[1:], b1)
+		return append(head, tail...), b2
+	}
+	if len(b) > 1 {
+		a1, head := transformOps(a, b[:1])
+		a2, tail := transformOps(a1, b[1:])
+		return a2, append(head, tail...)
+	}
+	return transformOp(a[0], b[0], false), transformOp(b[0], a[0], true)
+}
+
+// diffToOps turns a whole-document replacement into the minimal delete and
+// insert around the common prefix and suffix of the two texts.
+func diffToOps(oldContent, newContent string) []TextOp {
+	oldUnits := utf16.Encode([]rune(oldContent))
+	newUnits := utf16.Encode([]rune(newContent))
+
+	prefix := 0
+	for prefix < len(oldUnits) && prefix < len(newUnits) && oldUnits[prefix] == newUnits[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldUnits)-prefix && suffix < len(newUnits)-prefix &&
+		oldUnits[len(oldUnits)-1-suffix] == newUnits[len(newUnits)-1-suffix] {
+		suffix++
+	}
+	// Never split a surrogate pair between the unchanged and changed parts.
+	if prefix > 0 && utf16.IsSurrogate(rune(oldUnits[prefix-1])) && oldUnits[prefix-1] < 0xdc00 {
+		prefix--
+	}
+	if suffix > 0 && utf16.IsSurrogate(rune(oldUnits[len(oldUnits)-suffix])) && oldUnits[len(oldUnits)-suffix] >= 0xdc00 {
+		suffix--
+	}
+
+	var ops []TextOp
+	if deleted := len(oldUnits) - prefix - suffix; deleted > 0 {
+		ops = append(ops, TextOp{Type: OpDelete, Pos: prefix, Length: deleted})
+	}
+	if inserted := newUnits[prefix : len(newUnits)-suffix]; len(inserted) > 0 {
+		ops = append(ops, TextOp{Type: OpInsert, Pos: prefix, Text: string(utf16.Decode(inserted))})
+	}
+	return ops
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+)
+
+func ins(pos int, text string) TextOp {
+	return TextOp{Type: OpInsert, Pos: pos, Text: text}
+}
+
+func del(pos, length int) TextOp {
+	return TextOp{Type: OpDelete, Pos: pos, Length: length}
+}
+
+// TestTransformConverges checks TP1: applying a then b' gives the same text as
+// b then a', where a' and b' come from transformOps(a, b).
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b []TextOp
+		want string
+	}{
+		{"insert before insert", "abc", []TextOp{ins(0, "x")}, []TextOp{ins(2, "y")}, "xabyc"},
+		{"insert after insert", "abc", []TextOp{ins(3, "x")}, []TextOp{ins(1, "y")}, "aybcx"},
+		{"insert same place", "abc", []TextOp{ins(1, "x")}, []TextOp{ins(1, "y")}, "ayxbc"},
+		{"insert before delete", "abcdef", []TextOp{ins(1, "x")}, []TextOp{del(2, 2)}, "axbef"},
+		{"insert at delete start", "abcdef", []TextOp{ins(2, "x")}, []TextOp{del(2, 2)}, "abxef"},
+		{"insert inside delete", "abcdef", []TextOp{ins(3, "x")}, []TextOp{del(1, 3)}, "axef"},
+		{"insert at delete end", "abcdef", []TextOp{ins(4, "x")}, []TextOp{del(1, 3)}, "axef"},
+		{"insert after delete", "abcdef", []TextOp{ins(5, "x")}, []TextOp{del(1, 3)}, "aexf"},
+		{"delete split by insert", "abcdef", []TextOp{del(1, 4)}, []TextOp{ins(3, "xy")}, "axyf"},
+		{"deletes apart", "abcdef", []TextOp{del(0, 2)}, []TextOp{del(4, 1)}, "cdf"},
+		{"deletes touching", "abcdef", []TextOp{del(1, 2)}, []TextOp{del(3, 2)}, "af"},
+		{"deletes overlapping", "abcdef", []TextOp{del(1, 3)}, []TextOp{del(2, 3)}, "af"},
+		{"delete inside delete", "abcdef", []TextOp{del(2, 1)}, []TextOp{del(1, 4)}, "af"},
+		{"delete around delete", "abcdef", []TextOp{del(0, 6)}, []TextOp{del(2, 2)}, ""},
+		{"same delete", "abcdef", []TextOp{del(1, 2)}, []TextOp{del(1, 2)}, "adef"},
+		{"replace over replace", "abcdef", []TextOp{del(1, 3), ins(1, "x")}, []TextOp{del(2, 3), ins(2, "y")}, "ayxf"},
+		{"delete over split delete", "abcdefgh", []TextOp{del(2, 4)}, []TextOp{ins(4, "x"), del(1, 2)}, "axgh"},
+		{"several ops each side", "abcdefgh", []TextOp{ins(0, "1"), del(3, 2), ins(6, "2")}, []TextOp{del(1, 1), ins(5, "3"), del(7, 1)}, "1aef3g2"},
+		{"insert before surrogate pair", "a😀b", []TextOp{ins(1, "x")}, []TextOp{del(1, 2)}, "axb"},
+		{"insert after surrogate pair", "a😀b", []TextOp{ins(3, "😎")}, []TextOp{ins(1, "😀")}, "a😀😀😎b"},
+		{"delete surrogate pairs", "😀😀😀", []TextOp{del(0, 4)}, []TextOp{del(2, 4)}, ""},
+		{"insert between surrogate pairs", "😀😀", []TextOp{ins(2, "x")}, []TextOp{del(0, 4)}, "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aPrime, bPrime := transformOps(tt.a, tt.b)
+
+			afterB, ok := applyOps(tt.doc, tt.b)
+			if !ok {
+				t.Fatalf("b does not apply to %q", tt.doc)
+			}
+			viaB, ok := applyOps(afterB, aPrime)
+			if !ok {
+				t.Fatalf("a' %v does not apply to %q", aPrime, afterB)
+			}
+			afterA, ok := applyOps(tt.doc, tt.a)
+			if !ok {
+				t.Fatalf("a does not apply to %q", tt.doc)
+			}
+			viaA, ok := applyOps(afterA, bPrime)
+			if !ok {
+				t.Fatalf("b' %v does not apply to %q", bPrime, afterA)
+			}
+
+			if viaA != viaB {
+				t.Fatalf("diverged: a then b' gives %q, b then a' gives %q", viaA, viaB)
+			}
+			if viaA != tt.want {
+				t.Errorf("got %q, want %q", viaA, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"é", 1},
+		{"😀", 2},
+		{"a😀b", 4},
+	}
+	for _, tt := range tests {
+		if got := utf16Len(tt.text); got != tt.want {
+			t.Errorf("utf16Len(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestApplyOpsRejectsBadPositions(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []TextOp
+	}{
+		{"negative position", []TextOp{ins(-1, "x")}},
+		{"past the end", []TextOp{ins(5, "x")}},
+		{"delete past the end", []TextOp{del(3, 2)}},
+		{"negative length", []TextOp{del(1, -1)}},
+		{"unknown type", []TextOp{{Type: "replace", Pos: 0}}},
+		{"insert inside surrogate pair", []TextOp{ins(2, "x")}},
+		{"delete from inside surrogate pair", []TextOp{del(2, 1)}},
+		{"delete to inside surrogate pair", []TextOp{del(0, 2)}},
+		{"later op inside surrogate pair", []TextOp{ins(0, "x"), ins(3, "y")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := applyOps("a😀b", tt.ops); ok || got != "a😀b" {
+				t.Errorf("got %q, %v; want the content unchanged and false", got, ok)
+			}
+		})
+	}
+}
+
+func TestDiffToOps(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"unchanged", "abc", "abc"},
+		{"insert", "abc", "abxc"},
+		{"delete", "abc", "ac"},
+		{"replace", "abcdef", "abXYef"},
+		{"from empty", "", "abc"},
+		{"to empty", "abc", ""},
+		{"repeated text", "aaaa", "aaa"},
+		{"shared high surrogate", "a😀b", "a😁b"},
+		{"shared low surrogate", "😀", "🐀"},
+		{"surrogate pair added", "ab", "a😀b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := diffToOps(tt.old, tt.new)
+			if got, ok := applyOps(tt.old, ops); !ok || got != tt.new {
+				t.Errorf("ops %v give %q, %v; want %q", ops, got, ok, tt.new)
+			}
+			if tt.old == tt.new && len(ops) != 0 {
+				t.Errorf("got ops %v for unchanged text", ops)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+const (
+	// Content is written once a room has had no edits for this long...
+	contentFlushIdle = 2 * time.Second
+	// ...or at least this often while edits keep coming.
+	contentFlushInterval = 10 * time.Second
+)
+
+// Write-behind metrics, served from /o/metrics.
+var (
+	dirtyRoomsGauge    = expvar.NewInt("persist_dirty_rooms")
+	contentFlushes     = expvar.NewInt("persist_flushes")
+	contentFlushErrors = expvar.NewInt("persist_flush_errors")
+)
+
+// markContentDirty records that the room's text changed and schedules a
+// write. Consecutive edits are coalesced into a single write per room, which
+// flushForAuthor keeps to a single author.
+func (room *Room) markContentDirty(authorID string) {
+	now := time.Now()
+	if room.dirtySince.IsZero() {
+		room.dirtySince = now
+		dirtyRoomsGauge.Add(1)
+	}
+	room.dirtyAuthor = authorID
+
+	delay := min(contentFlushIdle, time.Until(room.dirtySince.Add(contentFlushInterval)))
+	room.flushTimer.Reset(delay)
+}
+
+// flushForAuthor writes pending content if anyone other than authorID made
+// it. It is called before applying an edit by authorID, so each revision is
+// the work of one author.
+func (room *Room) flushForAuthor(authorID string) {
+	if room.isContentDirty() && room.dirtyAuthor != authorID {
+		room.flushContentLogged()
+	}
+}
+
+func (room *Room) isContentDirty() bool {
+	return !room.dirtySince.IsZero()
+}
+
+func (room *Room) markContentClean() {
+	if room.isContentDirty() {
+		room.dirtySince = time.Time{}
+		room.dirtyAuthor = ""
+		room.flushTimer.Stop()
+		dirtyRoomsGauge.Add(-1)
+	}
+}
+
+// flushContent writes pending content, CRDT state and a history revision and
+// returns the revision number written, or 0 if nothing was pending. mode is
+// passed on to SaveRoomRevision. It must run on the room's goroutine.
+func (room *Room) flushContent(mode RevisionMode) (int, error) {
+	if !room.isContentDirty() {
+		return 0, nil
+	}
+
+	room.Doc.Compact(room.crdtAckedSeq())
+
+	number := 0
+	err := store.SaveRoomContent(room.Code, room.Content, room.Doc.Encode())
+	if err == nil {
+		number, err = store.SaveRoomRevision(room.Code, room.dirtyAuthor, room.Content, mode)
+	}
+	if err == nil {
+		err = room.flushCommentAnchors()
+	}
+	if err != nil {
+		contentFlushErrors.Add(1)
+		// Keep the room dirty so the next flush tries again.
+		room.flushTimer.Reset(contentFlushInterval)
+		return 0, err
+	}
+
+	contentFlushes.Add(1)
+	room.markContentClean()
+	return number, nil
+}
+
+// flushCommentAnchors saves the line anchors of comments that moved with
+// edits since the last flush.
+func (room *Room) flushCommentAnchors() error {
+	for _, comment := range room.Comments {
+		if !room.anchorsDirty[comment.ID] {
+			continue
+		}
+		if err := store.UpdateCommentAnchor(comment); err != nil {
+			return err
+		}
+		delete(room.anchorsDirty, comment.ID)
+	}
+	room.anchorsDirty = nil
+	return nil
+}
+
+func (room *Room) flushContentLogged() {
+	if _, err := room.flushContent(RevisionCoalesce); err != nil {
+		log.Printf("Error saving content for room %s: %v", room.Code, err)
+	}
+}
+
+// flushAllRooms writes every room's pending content, for graceful shutdown.
+func flushAllRooms() {
+	for _, room := range rooms.all() {
+		room.call(func(room *Room) {
+			room.flushContentLogged()
+		})
+	}
+}
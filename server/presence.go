@@ -0,0 +1,81 @@
+package main
+
+// Most selections accepted from one client.
+const maxSelections = 100
+
+// SelectionRange is a selection in the document as UTF-16 offsets, like
+// TextOp positions. Anchor is where the selection started and Head where the
+// cursor is; they are equal for a plain cursor.
+type SelectionRange struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// transformOffset moves pos through op. An insert exactly at pos pushes it
+// along only if moveOnTie is set, which is how a user's own typing carries
+// their cursor forward.
+func transformOffset(pos int, op TextOp, moveOnTie bool) int {
+	switch op.Type {
+	case OpInsert:
+		if pos > op.Pos || (pos == op.Pos && moveOnTie) {
+			return pos + op.size()
+		}
+	case OpDelete:
+		if pos >= op.Pos+op.Length {
+			return pos - op.Length
+		} else if pos > op.Pos {
+			return op.Pos
+		}
+	}
+	return pos
+}
+
+// transformSelections returns selections moved through ops. The result is a
+// new slice, since the old one may still be queued in outgoing messages.
+func transformSelections(selections []SelectionRange, ops []TextOp, moveOnTie bool) []SelectionRange {
+	moved := make([]SelectionRange, len(selections))
+	for i, sel := range selections {
+		for _, op := range ops {
+			sel.Anchor = transformOffset(sel.Anchor, op, moveOnTie)
+			sel.Head = transformOffset(sel.Head, op, moveOnTie)
+		}
+		moved[i] = sel
+	}
+	return moved
+}
+
+// transformPresence moves every connected user's selections through ops,
+// which clientID has just applied to the room.
+func (room *Room) transformPresence(clientID string, ops []TextOp) {
+	for id, client := range room.Clients {
+		if len(client.User.Selections) > 0 {
+			client.User.Selections = transformSelections(client.User.Selections, ops, id == clientID)
+		}
+	}
+}
+
+// rebaseSelections brings selections a client made at revision up to the
+// room's current revision, through every op applied since. The selections
+// are relative to the document at revision, so that includes the client's
+// own ops, which carry its cursor along as in transformPresence. It returns
+// false if revision is too old to rebase from.
+func (room *Room) rebaseSelections(clientID string, selections []SelectionRange, revision int) ([]SelectionRange, bool) {
+	if revision > room.Revision || revision < room.Revision-len(room.OpLog) {
+		return nil, false
+	}
+	if len(selections) > maxSelections {
+		selections = selections[:maxSelections]
+	}
+
+	rebased := transformSelections(selections, nil, false)
+	for _, rec := range room.OpLog[len(room.OpLog)-(room.Revision-revision):] {
+		rebased = transformSelections(rebased, rec.Ops, rec.ClientID == clientID)
+	}
+
+	length := utf16Len(room.Content)
+	for i := range rebased {
+		rebased[i].Anchor = max(0, min(rebased[i].Anchor, length))
+		rebased[i].Head = max(0, min(rebased[i].Head, length))
+	}
+	return rebased, true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRebaseSelections(t *testing.T) {
+	// "abcdef" at revision 1, then "me" inserted "XY" at 1 and "other"
+	// deleted "de"
+	room := &Room{
+		Content:  "aXYbcf",
+		Revision: 3,
+		OpLog: []textOpsRecord{
+			{Revision: 2, ClientID: "me", Ops: []TextOp{ins(1, "XY")}},
+			{Revision: 3, ClientID: "other", Ops: []TextOp{del(5, 2)}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		selections []SelectionRange
+		revision   int
+		want       []SelectionRange
+		ok         bool
+	}{
+		{"before own insert", []SelectionRange{{0, 0}}, 1, []SelectionRange{{0, 0}}, true},
+		{"at own insert", []SelectionRange{{1, 1}}, 1, []SelectionRange{{3, 3}}, true},
+		{"across both ops", []SelectionRange{{2, 6}}, 1, []SelectionRange{{4, 6}}, true},
+		{"inside the deletion", []SelectionRange{{4, 4}}, 1, []SelectionRange{{5, 5}}, true},
+		{"after own insert only", []SelectionRange{{6, 5}}, 2, []SelectionRange{{5, 5}}, true},
+		{"current revision", []SelectionRange{{2, 3}}, 3, []SelectionRange{{2, 3}}, true},
+		{"clamped to the content", []SelectionRange{{9, 9}}, 3, []SelectionRange{{6, 6}}, true},
+		{"unknown revision", []SelectionRange{{0, 0}}, 0, nil, false},
+		{"future revision", []SelectionRange{{0, 0}}, 4, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := room.rebaseSelections("me", tt.selections, tt.revision)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
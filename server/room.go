@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How often a room checks for clients that stopped pinging.
+	roomPingCheckInterval = 45 * time.Second
+	// Clients that haven't pinged for this long are disconnected.
+	clientPingTimeout = 60 * time.Second
+	// Rooms with no clients for this long retire their actor.
+	roomIdleTimeout = 10 * time.Minute
+)
+
+// roomCommand runs on a room's own goroutine, which is the only place room
+// state is read or written.
+type roomCommand func(room *Room)
+
+type Room struct {
+	Code       string
+	Content    string
+	Revision   int
+	OpLog      []textOpsRecord
+	Doc        *CRDTDoc
+	Clients    map[string]*Client
+	Comments   []Comment
+	Members    map[string]*RoomMember
+	MediaFiles []MediaFile
+	CreatedAt  time.Time
+
+	commands   chan roomCommand
+	done       chan struct{}
+	retired    bool
+	lastActive time.Time
+
+	// Write-behind state, see persist.go
+	dirtySince   time.Time
+	dirtyAuthor  string
+	flushTimer   *time.Timer
+	anchorsDirty map[string]bool
+
+	// Comments re-anchored by the current edit, see anchors.go
+	movedComments map[string]bool
+}
+
+// roomRegistry maps room codes to running room actors. Its lock only guards
+// the map itself and is never held while a room runs a command.
+type roomRegistry struct {
+	mutex sync.Mutex
+	rooms map[string]*Room
+}
+
+func newRoomRegistry() *roomRegistry {
+	return &roomRegistry{rooms: make(map[string]*Room)}
+}
+
+// get returns the running actor for code, or nil if the room isn't loaded.
+func (reg *roomRegistry) get(code string) *Room {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	return reg.rooms[code]
+}
+
+// acquire returns the running actor for code, spawning one if needed.
+func (reg *roomRegistry) acquire(code string) *Room {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if room, exists := reg.rooms[code]; exists {
+		return room
+	}
+	room := &Room{
+		Code:       code,
+		Clients:    make(map[string]*Client),
+		Members:    make(map[string]*RoomMember),
+		CreatedAt:  time.Now(),
+		commands:   make(chan roomCommand),
+		done:       make(chan struct{}),
+		lastActive: time.Now(),
+		flushTimer: time.NewTimer(contentFlushInterval),
+	}
+	room.flushTimer.Stop()
+	reg.rooms[code] = room
+	go room.run()
+	return room
+}
+
+func (reg *roomRegistry) remove(room *Room) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if reg.rooms[room.Code] == room {
+		delete(reg.rooms, room.Code)
+	}
+}
+
+func (reg *roomRegistry) all() []*Room {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	all := make([]*Room, 0, len(reg.rooms))
+	for _, room := range reg.rooms {
+		all = append(all, room)
+	}
+	return all
+}
+
+// do hands cmd to the room's actor if the room is loaded. It returns false if
+// the room isn't running, in which case cmd never runs.
+func (reg *roomRegistry) do(code string, cmd roomCommand) bool {
+	room := reg.get(code)
+	return room != nil && room.do(cmd)
+}
+
+// call is like do but waits for cmd to finish.
+func (reg *roomRegistry) call(code string, cmd roomCommand) bool {
+	room := reg.get(code)
+	return room != nil && room.call(cmd)
+}
+
+// do hands cmd to the actor without waiting for it to run. It returns false
+// if the actor has already retired.
+func (room *Room) do(cmd roomCommand) bool {
+	select {
+	case room.commands <- cmd:
+		return true
+	case <-room.done:
+		return false
+	}
+}
+
+func (room *Room) call(cmd roomCommand) bool {
+	finished := make(chan struct{})
+	if !room.do(func(r *Room) {
+		defer close(finished)
+		cmd(r)
+	}) {
+		return false
+	}
+	<-finished
+	return true
+}
+
+func (room *Room) run() {
+	room.load()
+
+	ticker := time.NewTicker(roomPingCheckInterval)
+	defer ticker.Stop()
+
+	for !room.retired {
+		select {
+		case cmd := <-room.commands:
+			cmd(room)
+			room.lastActive = time.Now()
+		case <-room.flushTimer.C:
+			room.flushContentLogged()
+		case <-ticker.C:
+			room.checkClientPings()
+			if len(room.Clients) == 0 && time.Since(room.lastActive) > roomIdleTimeout {
+				room.flushContentLogged()
+				if !room.isContentDirty() {
+					room.retire()
+				}
+			}
+		}
+	}
+	close(room.done)
+}
+
+func (room *Room) load() {
+	content, err := store.GetRoomContent(room.Code)
+	if err != nil {
+		log.Printf("Error retrieving content for room %s: %v", room.Code, err)
+	}
+
+	crdtState, err := store.GetRoomCRDT(room.Code)
+	if err != nil {
+		log.Printf("Error retrieving CRDT state for room %s: %v", room.Code, err)
+	}
+
+	comments, err := store.GetRoomComments(room.Code)
+	if err != nil {
+		log.Printf("Error retrieving comments for room %s: %v", room.Code, err)
+	}
+
+	members, err := store.GetRoomMembers(room.Code)
+	if err != nil {
+		log.Printf("Error retrieving members for room %s: %v", room.Code, err)
+	}
+
+	mediaFiles, err := store.GetRoomMedia(room.Code)
+	if err != nil {
+		log.Printf("Error retrieving media for room %s: %v", room.Code, err)
+	}
+
+	room.Content = content
+	room.Doc = loadCRDTDoc(crdtState, content)
+	room.Comments = comments
+	for i := range members {
+		room.Members[members[i].UserID] = &members[i]
+	}
+	room.MediaFiles = mediaFiles
+	log.Printf("Created new room: %s", room.Code)
+}
+
+// crdtAckedSeq returns the latest CRDT seq every connected CRDT client and
+// every peer the document remembers has acknowledged. Clients that join later
+// with an older one get a snapshot.
+func (room *Room) crdtAckedSeq() int {
+	now := time.Now()
+	seq := room.Doc.Seq()
+	for _, client := range room.Clients {
+		if client.UsesCRDT {
+			room.Doc.Ack(client.CRDTClient, client.CRDTSeq, now)
+			seq = min(seq, client.CRDTSeq)
+		}
+	}
+	return min(seq, room.Doc.AckedSeq(now))
+}
+
+// retire unregisters the room and stops its actor once the current command
+// returns. Commands sent afterwards fail, and the next acquire spawns a fresh
+// actor from the database, so pending content must be flushed or discarded
+// first.
+func (room *Room) retire() {
+	rooms.remove(room)
+	room.retired = true
+	log.Printf("Room %s retired", room.Code)
+}
+
+// disconnectAll closes every client connection. Their reader loops notice and
+// clean up on their own.
+func (room *Room) disconnectAll() {
+	for clientID, client := range room.Clients {
+		client.close()
+		delete(room.Clients, clientID)
+	}
+}
+
+func (room *Room) checkClientPings() {
+	for clientID, client := range room.Clients {
+		if time.Since(client.LastPing) > clientPingTimeout {
+			client.close()
+			delete(room.Clients, clientID)
+			log.Printf("Client %s timed out in room %s", clientID, room.Code)
+
+			// Broadcast user left
+			userLeftMsg := UserMessage{
+				BaseMessage: BaseMessage{Type: UserLeft, Code: room.Code},
+				User:        client.User,
+			}
+			broadcastToRoom(room, userLeftMsg, "")
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Rooms and comments fetched from the index per search.
+	searchLimit = 20
+	// Matching lines reported per room.
+	maxMatchesPerRoom = 5
+	// Characters of context kept around a match in a snippet.
+	snippetLength = 120
+)
+
+// SearchHit is a room or comment found by Store.Search. CommentID is empty
+// for hits in a room's content.
+type SearchHit struct {
+	RoomCode   string
+	CommentID  string
+	LineNumber *int
+	Content    string
+}
+
+// SearchMatch is one matching line of a room, or one matching comment.
+type SearchMatch struct {
+	CommentID  string `json:"commentId,omitempty"`
+	LineNumber *int   `json:"lineNumber"`
+	Snippet    string `json:"snippet"`
+}
+
+type SearchResult struct {
+	RoomCode string        `json:"roomCode"`
+	Matches  []SearchMatch `json:"matches"`
+}
+
+// handleSearch serves GET /o/search?q=...&userId=... over the rooms the user
+// is a member of, with the user's token in an Authorization: Bearer header.
+// Room content is searched as last saved, so the most recent few seconds of
+// edits may not be found yet.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("userId")
+	if userID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if !requestHasToken(r, userID) {
+		http.Error(w, "Invalid token for userId", http.StatusUnauthorized)
+		return
+	}
+	terms := strings.Fields(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	hits, err := store.Search(userID, terms, searchLimit)
+	if err != nil {
+		log.Printf("Error searching for %q: %v", r.URL.Query().Get("q"), err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	results := []SearchResult{}
+	byRoom := make(map[string]int)
+	for _, hit := range hits {
+		i, exists := byRoom[hit.RoomCode]
+		if !exists {
+			i = len(results)
+			byRoom[hit.RoomCode] = i
+			results = append(results, SearchResult{RoomCode: hit.RoomCode, Matches: []SearchMatch{}})
+		}
+
+		if hit.CommentID != "" {
+			results[i].Matches = append(results[i].Matches, SearchMatch{
+				CommentID:  hit.CommentID,
+				LineNumber: hit.LineNumber,
+				Snippet:    snippet(hit.Content, terms),
+			})
+			continue
+		}
+		for n, line := range strings.Split(hit.Content, "\n") {
+			if len(results[i].Matches) == maxMatchesPerRoom {
+				break
+			}
+			if matchIndex(line, terms) < 0 {
+				continue
+			}
+			lineNumber := n + 1
+			results[i].Matches = append(results[i].Matches, SearchMatch{
+				LineNumber: &lineNumber,
+				Snippet:    snippet(line, terms),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// matchIndex returns the byte offset of the first term found in text,
+// ignoring case, or -1.
+func matchIndex(text string, terms []string) int {
+	lower := strings.ToLower(text)
+	first := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, strings.ToLower(term)); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	// Lowercasing can change the length of some characters; only trust
+	// offsets that still land on a character boundary of text.
+	if first >= len(text) || (first > 0 && !utf8.RuneStart(text[first])) {
+		return 0
+	}
+	return first
+}
+
+// snippet returns the part of text around its first match, on one line and
+// at most snippetLength characters long.
+func snippet(text string, terms []string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= snippetLength {
+		return text
+	}
+
+	start := 0
+	if i := matchIndex(text, terms); i > 0 {
+		start = max(utf8.RuneCountInString(text[:i])-snippetLength/4, 0)
+	}
+	end := min(start+snippetLength, len(runes))
+	start = max(end-snippetLength, 0)
+
+	s := string(runes[start:end])
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(runes) {
+		s += "…"
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// allowedUploadTypes lists the media types that may be uploaded, as set by
+// UPLOAD_ALLOWED_TYPES. An entry like "image/*" allows a whole category.
+var allowedUploadTypes = []string{"image/*", "video/*", "audio/*", "text/plain", "application/pdf", "application/zip"}
+
+var errUploadType = errors.New("file type rejected")
+
+// sniffAliases maps types http.DetectContentType reports to more specific
+// types that have the same signature, so a client declaring one of these
+// isn't mistaken for lying about its content.
+var sniffAliases = map[string][]string{
+	"application/ogg": {"audio/ogg", "video/ogg", "audio/opus"},
+	"application/zip": {
+		"application/epub+zip",
+		"application/vnd.oasis.opendocument.presentation",
+		"application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.oasis.opendocument.text",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/x-zip-compressed",
+	},
+	"audio/wave": {"audio/wav", "audio/x-wav"},
+	"image/jpeg": {"image/jpg"},
+	// Only formats browsers won't run scripts from; HTML, SVG, XML and
+	// JavaScript must sniff as what they are
+	"text/plain": {"application/json", "text/csv", "text/markdown", "text/tab-separated-values"},
+	"text/xml":   {"application/xml"},
+	"video/webm": {"audio/webm"},
+}
+
+// parseUploadTypes reads a comma separated list of allowed types.
+func parseUploadTypes(value string) []string {
+	var types []string
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func uploadTypeAllowed(mediaType string) bool {
+	for _, allowed := range allowedUploadTypes {
+		if allowed == mediaType || allowed == "*/*" {
+			return true
+		}
+		if category, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, category+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// baseMediaType strips parameters such as charset from a media type.
+func baseMediaType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// sameContentType reports whether content sniffed as sniffed can honestly be
+// declared as declared.
+func sameContentType(declared, sniffed string) bool {
+	if declared == sniffed {
+		return true
+	}
+	return slices.Contains(sniffAliases[sniffed], declared)
+}
+
+// detectUploadType sniffs the file at path and checks it against the type the
+// client declared and the allowlist. It returns the type to record, which is
+// the declared one if it agrees with the content and otherwise the sniffed
+// one. Errors wrap errUploadType with a message for the client.
+func detectUploadType(path, declared string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	sniffed := baseMediaType(http.DetectContentType(head[:n]))
+
+	mediaType := sniffed
+	declared = baseMediaType(declared)
+	if declared != "" && declared != "application/octet-stream" {
+		if !sameContentType(declared, sniffed) {
+			return "", fmt.Errorf("%w: declared as %s but looks like %s", errUploadType, declared, sniffed)
+		}
+		mediaType = declared
+	}
+
+	// The content decides what is allowed, except that a type sniffing
+	// can't tell apart from its signature is checked as declared
+	checked := sniffed
+	if slices.Contains(sniffAliases[sniffed], mediaType) {
+		checked = mediaType
+	}
+	if !uploadTypeAllowed(checked) {
+		return "", fmt.Errorf("%w: %s is not allowed", errUploadType, checked)
+	}
+	return mediaType, nil
+}
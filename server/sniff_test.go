@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectUploadType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	tests := []struct {
+		name     string
+		content  string
+		declared string
+		want     string // empty if the upload is rejected
+	}{
+		{"declared correctly", png, "image/png", "image/png"},
+		{"nothing declared", png, "", "image/png"},
+		{"octet stream declared", png, "application/octet-stream", "image/png"},
+		{"parameters ignored", "hello", "text/plain; charset=utf-8", "text/plain"},
+		{"declared wrongly", png, "image/jpeg", ""},
+		{"alias of the sniffed type", "\xff\xd8\xff\xe0", "image/jpg", "image/jpg"},
+		{"ogg audio", "OggS\x00", "audio/ogg", "audio/ogg"},
+		// Checked as declared, and not in the default allowlist
+		{"markdown", "# Title\n", "text/markdown", ""},
+		{"json", `{"a": 1}`, "application/json", ""},
+		{"pdf", "%PDF-1.4\n", "application/pdf", "application/pdf"},
+		{"html as html", "<!DOCTYPE html><script>alert(1)</script>", "text/html", ""},
+		{"html as text", "<!DOCTYPE html><script>alert(1)</script>", "text/plain", ""},
+		{"text as html", "alert(1)", "text/html", ""},
+		{"text as javascript", "alert(1)", "text/javascript", ""},
+		{"text as svg", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, "image/svg+xml", ""},
+		{"text as xml", "<a/>", "application/xml", ""},
+		{"sniffed image", "GIF89a", "", "image/gif"},
+		{"unknown binary", "\x00\x01\x02\x03", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := detectUploadType(path, tt.declared)
+			if tt.want == "" {
+				if !errors.Is(err, errUploadType) {
+					t.Errorf("got %q, %v; want errUploadType", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectUploadTypeChecksAliasAsDeclared(t *testing.T) {
+	defer func(types []string) { allowedUploadTypes = types }(allowedUploadTypes)
+	allowedUploadTypes = []string{"text/markdown"}
+
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, []byte("# Title\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := detectUploadType(path, "text/markdown"); err != nil || got != "text/markdown" {
+		t.Errorf("got %q, %v; want text/markdown", got, err)
+	}
+	if got, err := detectUploadType(path, "text/plain"); !errors.Is(err, errUploadType) {
+		t.Errorf("got %q, %v for plain text; want errUploadType", got, err)
+	}
+}
+
+func TestUploadTypeAllowed(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		want      bool
+	}{
+		{"image/png", true},
+		{"video/mp4", true},
+		{"text/plain", true},
+		{"text/html", false},
+		{"application/pdf", true},
+		{"application/x-msdownload", false},
+		{"imagex/png", false},
+	}
+	for _, tt := range tests {
+		if got := uploadTypeAllowed(tt.mediaType); got != tt.want {
+			t.Errorf("uploadTypeAllowed(%q) = %v, want %v", tt.mediaType, got, tt.want)
+		}
+	}
+}
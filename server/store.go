@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Store persists rooms, their history, comments and media metadata. Lookups
+// of a single record return sql.ErrNoRows when it doesn't exist.
+type Store interface {
+	// SaveRoomContent writes a room's text and CRDT state together.
+	SaveRoomContent(code, content string, crdtState []byte) error
+	GetRoomContent(code string) (string, error)
+	GetRoomCRDT(code string) ([]byte, error)
+	DeleteRoomContent(code string) error
+	// RoomsSavedBefore lists rooms whose content was last saved before t.
+	RoomsSavedBefore(t time.Time) ([]string, error)
+
+	// SaveRoomRevision records content as the room's next numbered revision,
+	// treating the latest revision as mode says. It returns the revision
+	// number written.
+	SaveRoomRevision(code, authorID, content string, mode RevisionMode) (int, error)
+	GetRoomRevisions(code string) ([]RoomRevision, error)
+	GetRoomRevision(code string, number int) (RoomRevision, error)
+	DeleteRoomRevisions(code string) error
+
+	SaveComment(roomCode string, comment Comment) error
+	// UpdateCommentContent replaces a comment's text, keeping previous as
+	// its latest version.
+	UpdateCommentContent(previous Comment, content string, editedAt time.Time) error
+	GetCommentVersions(roomCode, commentID string) ([]CommentVersion, error)
+	SetCommentResolved(commentID string, resolved bool, resolvedBy *string, resolvedAt *time.Time) error
+	AddCommentReaction(commentID, userID, emoji string) error
+	RemoveCommentReaction(commentID, userID, emoji string) error
+	// UpdateCommentAnchor saves a comment's line anchor and outdated flag.
+	UpdateCommentAnchor(comment Comment) error
+	// MarkCommentDeleted turns a comment into a tombstone, dropping its text
+	// and earlier versions but keeping the row so replies stay attached.
+	MarkCommentDeleted(commentID, deletedBy string, deletedAt time.Time) error
+	GetRoomComments(roomCode string) ([]Comment, error)
+	DeleteRoomComments(roomCode string) error
+
+	SaveRoomMember(roomCode string, member RoomMember) error
+	GetRoomMembers(roomCode string) ([]RoomMember, error)
+	DeleteRoomMembers(roomCode string) error
+	// DemoteUser makes userID a plain member wherever it holds a higher
+	// role and returns the rooms that changed.
+	DemoteUser(userID string) ([]string, error)
+
+	// SaveUserToken records the hash of userID's token unless it already
+	// has one, and reports whether it was saved.
+	SaveUserToken(userID, tokenHash string) (bool, error)
+	// GetUserToken returns the hash of userID's token, or sql.ErrNoRows.
+	GetUserToken(userID string) (string, error)
+
+	// SaveChatMessage stores message as the room's next chat message and
+	// returns its number.
+	SaveChatMessage(roomCode string, message ChatEntry) (int, error)
+	// GetChatMessages returns up to limit of the room's chat messages
+	// numbered below before, or the latest ones if before is 0, oldest first.
+	GetChatMessages(roomCode string, before, limit int) ([]ChatEntry, error)
+	DeleteRoomChat(roomCode string) error
+
+	SaveMention(userID string, mention Mention) error
+	// GetUnreadMentions returns userID's unread mentions, oldest first.
+	GetUnreadMentions(userID string) ([]Mention, error)
+	// MarkMentionsRead marks the given mentions of userID read, or all of
+	// them if ids is empty.
+	MarkMentionsRead(userID string, ids []string, readAt time.Time) error
+	DeleteRoomMentions(roomCode string) error
+
+	// Search returns up to limit rooms and up to limit comments containing
+	// every term, best matches first, from the rooms userID is a member of.
+	Search(userID string, terms []string, limit int) ([]SearchHit, error)
+
+	SaveMediaFile(roomCode string, media MediaFile) error
+	GetMediaFile(roomCode, mediaID string) (MediaFile, error)
+	// UpdateMediaThumbnail records an image's dimensions and thumbnail URL,
+	// which may be empty if no thumbnail could be made.
+	UpdateMediaThumbnail(mediaID, thumbnailURL string, width, height int) error
+	DeleteMediaFile(mediaID string) error
+	GetRoomMedia(roomCode string) ([]MediaFile, error)
+	// RoomMediaSize returns the total size of the room's media files.
+	RoomMediaSize(roomCode string) (int64, error)
+	DeleteRoomMedia(roomCode string) error
+
+	// AddBlobRef counts a new reference to the blob with the given hash,
+	// recording the blob if it's new, and reports whether it was.
+	AddBlobRef(hash string, size int64) (bool, error)
+	// ReleaseBlob drops a reference to a blob and reports whether that was
+	// the last one, in which case the blob is forgotten.
+	ReleaseBlob(hash string) (bool, error)
+
+	SaveUpload(upload ResumableUpload) error
+	GetUpload(id string) (ResumableUpload, error)
+	UpdateUploadOffset(id string, offset int64) error
+	DeleteUpload(id string) error
+	DeleteRoomUploads(roomCode string) error
+	// RoomPendingUploadSize returns the total length of the room's
+	// unfinished uploads.
+	RoomPendingUploadSize(roomCode string) (int64, error)
+	// GetUploadsCreatedBefore returns unfinished uploads started before t.
+	GetUploadsCreatedBefore(t time.Time) ([]ResumableUpload, error)
+
+	// Schema migrations, see migrate.go.
+	MigrateUp() ([]Migration, error)
+	MigrateDown() (*Migration, error)
+	MigrationStatus() ([]MigrationStatus, error)
+
+	Close() error
+}
+
+// RevisionMode says how SaveRoomRevision treats the room's latest revision.
+type RevisionMode int
+
+const (
+	// RevisionNew adds a revision unless the content matches the latest.
+	RevisionNew RevisionMode = iota
+	// RevisionCoalesce also updates the latest revision in place when it is
+	// by the same author and was changed within revisionCoalesceWindow.
+	RevisionCoalesce
+	// RevisionForce always adds a revision, so a restore shows up in history
+	// even when it changes nothing.
+	RevisionForce
+)
+
+// openStore connects to PostgreSQL when DATABASE_URL is set and falls back to
+// the local SQLite database otherwise. The schema isn't touched until
+// MigrateUp runs.
+func openStore() (Store, error) {
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		return newPostgresStore(databaseURL)
+	}
+	return newSQLiteStore("./rooms.db")
+}
@@ -0,0 +1,818 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlStore implements Store on top of database/sql. Queries are written with
+// ? placeholders and in SQL that SQLite and PostgreSQL both accept; rebind
+// adapts the placeholders for drivers that need something else. dialect
+// selects the directory under migrations/ holding the schema.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+	rebind  func(query string) string
+	// fts5 is set for SQLite builds with FTS5, which search uses if present.
+	fts5 bool
+}
+
+// rebindDollar rewrites ? placeholders as PostgreSQL's $1, $2, ...
+func rebindDollar(query string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (s *sqlStore) q(query string) string {
+	if s.rebind == nil {
+		return query
+	}
+	return s.rebind(query)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) SaveRoomContent(code, content string, crdtState []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// created_at tracks the last save so that deleteOldRooms only removes
+	// rooms nobody has touched for a day.
+	if _, err := tx.Exec(s.q(`INSERT INTO rooms (code, content) VALUES (?, ?)
+		ON CONFLICT (code) DO UPDATE SET content = excluded.content, created_at = CURRENT_TIMESTAMP`), code, content); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.q(`INSERT INTO room_crdt (room_code, state) VALUES (?, ?)
+		ON CONFLICT (room_code) DO UPDATE SET state = excluded.state`), code, crdtState); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) GetRoomContent(code string) (string, error) {
+	var content string
+	err := s.db.QueryRow(s.q("SELECT content FROM rooms WHERE code = ?"), code).Scan(&content)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return content, nil
+}
+
+func (s *sqlStore) GetRoomCRDT(code string) ([]byte, error) {
+	var state []byte
+	err := s.db.QueryRow(s.q("SELECT state FROM room_crdt WHERE room_code = ?"), code).Scan(&state)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *sqlStore) DeleteRoomContent(code string) error {
+	if _, err := s.db.Exec(s.q("DELETE FROM room_crdt WHERE room_code = ?"), code); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(s.q("DELETE FROM rooms WHERE code = ?"), code)
+	return err
+}
+
+func (s *sqlStore) RoomsSavedBefore(t time.Time) ([]string, error) {
+	rows, err := s.db.Query(s.q("SELECT code FROM rooms WHERE created_at < ?"), t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roomCodes []string
+	for rows.Next() {
+		var roomCode string
+		if err := rows.Scan(&roomCode); err != nil {
+			log.Printf("Error scanning room code: %v", err)
+			continue
+		}
+		roomCodes = append(roomCodes, roomCode)
+	}
+	return roomCodes, rows.Err()
+}
+
+func (s *sqlStore) SaveRoomRevision(code, authorID, content string, mode RevisionMode) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var latest RoomRevision
+	err = tx.QueryRow(s.q(`SELECT number, author_id, content, created_at, updated_at FROM room_revisions
+		WHERE room_code = ? ORDER BY number DESC LIMIT 1`), code).Scan(&latest.Number, &latest.AuthorID, &latest.Content, &latest.Timestamp, &latest.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	number := latest.Number + 1
+	switch {
+	case mode != RevisionForce && latest.Number > 0 && latest.Content == content:
+		return latest.Number, nil
+	case mode == RevisionCoalesce && latest.Number > 0 && latest.AuthorID == authorID && time.Since(latest.UpdatedAt) < revisionCoalesceWindow:
+		number = latest.Number
+		_, err = tx.Exec(s.q("UPDATE room_revisions SET content = ?, updated_at = ? WHERE room_code = ? AND number = ?"),
+			content, time.Now(), code, number)
+	default:
+		now := time.Now()
+		_, err = tx.Exec(s.q(`INSERT INTO room_revisions (room_code, number, author_id, content, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)`), code, number, authorID, content, now, now)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return number, tx.Commit()
+}
+
+func (s *sqlStore) GetRoomRevisions(code string) ([]RoomRevision, error) {
+	rows, err := s.db.Query(s.q(`SELECT number, author_id, created_at, updated_at, octet_length(content)
+		FROM room_revisions WHERE room_code = ? ORDER BY number ASC`), code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []RoomRevision
+	for rows.Next() {
+		var revision RoomRevision
+		err := rows.Scan(&revision.Number, &revision.AuthorID, &revision.Timestamp, &revision.UpdatedAt, &revision.Size)
+		if err != nil {
+			log.Printf("Error scanning revision: %v", err)
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+func (s *sqlStore) GetRoomRevision(code string, number int) (RoomRevision, error) {
+	revision := RoomRevision{Number: number}
+	err := s.db.QueryRow(s.q(`SELECT author_id, created_at, updated_at, content FROM room_revisions
+		WHERE room_code = ? AND number = ?`), code, number).Scan(&revision.AuthorID, &revision.Timestamp, &revision.UpdatedAt, &revision.Content)
+	revision.Size = len(revision.Content)
+	return revision, err
+}
+
+func (s *sqlStore) DeleteRoomRevisions(code string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM room_revisions WHERE room_code = ?"), code)
+	return err
+}
+
+func (s *sqlStore) SaveComment(roomCode string, comment Comment) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO comments (id, room_code, line_number, line_range, author, author_id, content, timestamp, parent_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		comment.ID, roomCode, comment.LineNumber, comment.LineRange,
+		comment.Author, comment.AuthorID, comment.Content, comment.Timestamp, comment.ParentID)
+	return err
+}
+
+func (s *sqlStore) MarkCommentDeleted(commentID, deletedBy string, deletedAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.q("DELETE FROM comment_versions WHERE comment_id = ?"), commentID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.q("DELETE FROM comment_reactions WHERE comment_id = ?"), commentID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.q("UPDATE comments SET content = '', deleted_by = ?, deleted_at = ? WHERE id = ?"),
+		deletedBy, deletedAt, commentID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) UpdateCommentContent(previous Comment, content string, editedAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The replaced text dates from the last edit, or from when the comment
+	// was posted if this is the first one.
+	writtenAt := previous.Timestamp
+	if previous.EditedAt != nil {
+		writtenAt = *previous.EditedAt
+	}
+	var version int
+	err = tx.QueryRow(s.q("SELECT COALESCE(MAX(version), 0) + 1 FROM comment_versions WHERE comment_id = ?"), previous.ID).Scan(&version)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.q(`INSERT INTO comment_versions (comment_id, version, content, created_at)
+		VALUES (?, ?, ?, ?)`), previous.ID, version, previous.Content, writtenAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.q("UPDATE comments SET content = ?, edited_at = ? WHERE id = ?"), content, editedAt, previous.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SetCommentResolved(commentID string, resolved bool, resolvedBy *string, resolvedAt *time.Time) error {
+	_, err := s.db.Exec(s.q("UPDATE comments SET resolved = ?, resolved_by = ?, resolved_at = ? WHERE id = ?"),
+		resolved, resolvedBy, resolvedAt, commentID)
+	return err
+}
+
+func (s *sqlStore) AddCommentReaction(commentID, userID, emoji string) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO comment_reactions (comment_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (comment_id, user_id, emoji) DO NOTHING`), commentID, userID, emoji, time.Now())
+	return err
+}
+
+func (s *sqlStore) RemoveCommentReaction(commentID, userID, emoji string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM comment_reactions WHERE comment_id = ? AND user_id = ? AND emoji = ?"),
+		commentID, userID, emoji)
+	return err
+}
+
+func (s *sqlStore) UpdateCommentAnchor(comment Comment) error {
+	_, err := s.db.Exec(s.q("UPDATE comments SET line_number = ?, line_range = ?, outdated = ? WHERE id = ?"),
+		comment.LineNumber, comment.LineRange, comment.Outdated, comment.ID)
+	return err
+}
+
+func (s *sqlStore) GetCommentVersions(roomCode, commentID string) ([]CommentVersion, error) {
+	rows, err := s.db.Query(s.q(`SELECT v.version, v.content, v.created_at
+		FROM comment_versions v JOIN comments c ON c.id = v.comment_id
+		WHERE c.room_code = ? AND v.comment_id = ? ORDER BY v.version ASC`), roomCode, commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []CommentVersion
+	for rows.Next() {
+		var version CommentVersion
+		if err := rows.Scan(&version.Version, &version.Content, &version.Timestamp); err != nil {
+			log.Printf("Error scanning comment version: %v", err)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func (s *sqlStore) GetRoomComments(roomCode string) ([]Comment, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, line_number, line_range, author, author_id, content, timestamp, edited_at, parent_id,
+		resolved, resolved_by, resolved_at, outdated, deleted_by, deleted_at
+		FROM comments WHERE room_code = ? ORDER BY timestamp ASC`), roomCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var comment Comment
+		err := rows.Scan(&comment.ID, &comment.LineNumber, &comment.LineRange,
+			&comment.Author, &comment.AuthorID, &comment.Content, &comment.Timestamp, &comment.EditedAt, &comment.ParentID,
+			&comment.Resolved, &comment.ResolvedBy, &comment.ResolvedAt, &comment.Outdated,
+			&comment.DeletedBy, &comment.DeletedAt)
+		if err != nil {
+			log.Printf("Error scanning comment: %v", err)
+			continue
+		}
+		comment.Deleted = comment.DeletedAt != nil
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadCommentReactions(roomCode, comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// loadCommentReactions fills in the aggregated reactions of comments, in the
+// order each emoji was first used.
+func (s *sqlStore) loadCommentReactions(roomCode string, comments []Comment) error {
+	rows, err := s.db.Query(s.q(`SELECT r.comment_id, r.user_id, r.emoji
+		FROM comment_reactions r JOIN comments c ON c.id = r.comment_id
+		WHERE c.room_code = ? ORDER BY r.created_at ASC`), roomCode)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[string]int, len(comments))
+	for i, comment := range comments {
+		index[comment.ID] = i
+	}
+	for rows.Next() {
+		var commentID, userID, emoji string
+		if err := rows.Scan(&commentID, &userID, &emoji); err != nil {
+			log.Printf("Error scanning comment reaction: %v", err)
+			continue
+		}
+		if i, ok := index[commentID]; ok {
+			comments[i].addReaction(userID, emoji)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) DeleteRoomComments(roomCode string) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM comment_versions
+		WHERE comment_id IN (SELECT id FROM comments WHERE room_code = ?)`), roomCode)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q(`DELETE FROM comment_reactions
+		WHERE comment_id IN (SELECT id FROM comments WHERE room_code = ?)`), roomCode)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q("DELETE FROM comments WHERE room_code = ?"), roomCode)
+	return err
+}
+
+func (s *sqlStore) SaveRoomMember(roomCode string, member RoomMember) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO room_members (room_code, user_id, name, role, joined_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (room_code, user_id) DO UPDATE SET name = excluded.name, role = excluded.role`),
+		roomCode, member.UserID, member.Name, member.Role, member.JoinedAt)
+	return err
+}
+
+func (s *sqlStore) GetRoomMembers(roomCode string) ([]RoomMember, error) {
+	rows, err := s.db.Query(s.q(`SELECT user_id, name, role, joined_at
+		FROM room_members WHERE room_code = ? ORDER BY joined_at ASC`), roomCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []RoomMember
+	for rows.Next() {
+		var member RoomMember
+		if err := rows.Scan(&member.UserID, &member.Name, &member.Role, &member.JoinedAt); err != nil {
+			log.Printf("Error scanning room member: %v", err)
+			continue
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *sqlStore) DeleteRoomMembers(roomCode string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM room_members WHERE room_code = ?"), roomCode)
+	return err
+}
+
+func (s *sqlStore) SaveUserToken(userID, tokenHash string) (bool, error) {
+	result, err := s.db.Exec(s.q(`INSERT INTO user_tokens (user_id, token_hash) VALUES (?, ?)
+		ON CONFLICT (user_id) DO NOTHING`), userID, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) DemoteUser(userID string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(s.q("SELECT room_code FROM room_members WHERE user_id = ? AND role <> ?"), userID, RoleMember)
+	if err != nil {
+		return nil, err
+	}
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(codes) == 0 {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(s.q("UPDATE room_members SET role = ? WHERE user_id = ? AND role <> ?"), RoleMember, userID, RoleMember); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func (s *sqlStore) GetUserToken(userID string) (string, error) {
+	var tokenHash string
+	err := s.db.QueryRow(s.q("SELECT token_hash FROM user_tokens WHERE user_id = ?"), userID).Scan(&tokenHash)
+	return tokenHash, err
+}
+
+func (s *sqlStore) SaveChatMessage(roomCode string, message ChatEntry) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var latest sql.NullInt64
+	err = tx.QueryRow(s.q("SELECT MAX(number) FROM chat_messages WHERE room_code = ?"), roomCode).Scan(&latest)
+	if err != nil {
+		return 0, err
+	}
+
+	number := int(latest.Int64) + 1
+	_, err = tx.Exec(s.q(`INSERT INTO chat_messages (room_code, number, id, author, author_id, content, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		roomCode, number, message.ID, message.Author, message.AuthorID, message.Content, message.Timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return number, tx.Commit()
+}
+
+func (s *sqlStore) GetChatMessages(roomCode string, before, limit int) ([]ChatEntry, error) {
+	query := `SELECT number, id, author, author_id, content, created_at
+		FROM chat_messages WHERE room_code = ? ORDER BY number DESC LIMIT ?`
+	args := []interface{}{roomCode, limit}
+	if before > 0 {
+		query = `SELECT number, id, author, author_id, content, created_at
+			FROM chat_messages WHERE room_code = ? AND number < ? ORDER BY number DESC LIMIT ?`
+		args = []interface{}{roomCode, before, limit}
+	}
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ChatEntry
+	for rows.Next() {
+		var message ChatEntry
+		if err := rows.Scan(&message.Number, &message.ID, &message.Author, &message.AuthorID,
+			&message.Content, &message.Timestamp); err != nil {
+			log.Printf("Error scanning chat message: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	// Fetched newest first to apply the limit; return them in order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *sqlStore) DeleteRoomChat(roomCode string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM chat_messages WHERE room_code = ?"), roomCode)
+	return err
+}
+
+func (s *sqlStore) SaveMention(userID string, mention Mention) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO mentions (id, user_id, room_code, comment_id, author, author_id, excerpt, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		mention.ID, userID, mention.RoomCode, mention.CommentID, mention.Author, mention.AuthorID, mention.Excerpt, mention.Timestamp)
+	return err
+}
+
+func (s *sqlStore) GetUnreadMentions(userID string) ([]Mention, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, room_code, comment_id, author, author_id, excerpt, created_at
+		FROM mentions WHERE user_id = ? AND read_at IS NULL ORDER BY created_at ASC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []Mention
+	for rows.Next() {
+		var mention Mention
+		if err := rows.Scan(&mention.ID, &mention.RoomCode, &mention.CommentID, &mention.Author,
+			&mention.AuthorID, &mention.Excerpt, &mention.Timestamp); err != nil {
+			log.Printf("Error scanning mention: %v", err)
+			continue
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, nil
+}
+
+func (s *sqlStore) MarkMentionsRead(userID string, ids []string, readAt time.Time) error {
+	if len(ids) == 0 {
+		_, err := s.db.Exec(s.q("UPDATE mentions SET read_at = ? WHERE user_id = ? AND read_at IS NULL"), readAt, userID)
+		return err
+	}
+
+	args := []interface{}{readAt, userID}
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	_, err := s.db.Exec(s.q(`UPDATE mentions SET read_at = ?
+		WHERE user_id = ? AND read_at IS NULL AND id IN (`+strings.Join(placeholders, ", ")+")"), args...)
+	return err
+}
+
+func (s *sqlStore) DeleteRoomMentions(roomCode string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM mentions WHERE room_code = ?"), roomCode)
+	return err
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *sqlStore) Search(userID string, terms []string, limit int) ([]SearchHit, error) {
+	var roomQuery, commentQuery string
+	var args []interface{}
+	if s.dialect == "postgres" {
+		roomQuery = `SELECT r.code, '', NULL, r.content FROM rooms r
+			JOIN room_members m ON m.room_code = r.code AND m.user_id = ?
+			WHERE to_tsvector('simple', coalesce(r.content, '')) @@ plainto_tsquery('simple', ?)
+			ORDER BY ts_rank(to_tsvector('simple', coalesce(r.content, '')), plainto_tsquery('simple', ?)) DESC
+			LIMIT ?`
+		commentQuery = `SELECT c.room_code, c.id, c.line_number, c.content FROM comments c
+			JOIN room_members m ON m.room_code = c.room_code AND m.user_id = ?
+			WHERE to_tsvector('simple', coalesce(c.content, '')) @@ plainto_tsquery('simple', ?)
+			ORDER BY ts_rank(to_tsvector('simple', coalesce(c.content, '')), plainto_tsquery('simple', ?)) DESC
+			LIMIT ?`
+		match := strings.Join(terms, " ")
+		args = []interface{}{userID, match, match, limit}
+	} else if !s.fts5 {
+		// Without the index every term is looked for with LIKE, which
+		// ignores ASCII case like the index does
+		var roomMatch, commentMatch []string
+		args = []interface{}{userID}
+		for _, term := range terms {
+			roomMatch = append(roomMatch, `r.content LIKE ? ESCAPE '\'`)
+			commentMatch = append(commentMatch, `c.content LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+		args = append(args, limit)
+		roomQuery = `SELECT r.code, '', NULL, r.content FROM rooms r
+			JOIN room_members m ON m.room_code = r.code AND m.user_id = ?
+			WHERE ` + strings.Join(roomMatch, " AND ") + `
+			LIMIT ?`
+		commentQuery = `SELECT c.room_code, c.id, c.line_number, c.content FROM comments c
+			JOIN room_members m ON m.room_code = c.room_code AND m.user_id = ?
+			WHERE ` + strings.Join(commentMatch, " AND ") + `
+			LIMIT ?`
+	} else {
+		roomQuery = `SELECT r.code, '', NULL, r.content FROM rooms_fts
+			JOIN rooms r ON r.rowid = rooms_fts.rowid
+			JOIN room_members m ON m.room_code = r.code AND m.user_id = ?
+			WHERE rooms_fts MATCH ?
+			ORDER BY rooms_fts.rank
+			LIMIT ?`
+		commentQuery = `SELECT c.room_code, c.id, c.line_number, c.content FROM comments_fts
+			JOIN comments c ON c.rowid = comments_fts.rowid
+			JOIN room_members m ON m.room_code = c.room_code AND m.user_id = ?
+			WHERE comments_fts MATCH ?
+			ORDER BY comments_fts.rank
+			LIMIT ?`
+		// Quote every term so FTS5 doesn't read the user's text as query
+		// syntax; adjacent strings must all match.
+		quoted := make([]string, len(terms))
+		for i, term := range terms {
+			quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		}
+		args = []interface{}{userID, strings.Join(quoted, " "), limit}
+	}
+
+	var hits []SearchHit
+	for _, query := range []string{roomQuery, commentQuery} {
+		rows, err := s.db.Query(s.q(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var hit SearchHit
+			var lineNumber sql.NullInt64
+			var content sql.NullString
+			if err := rows.Scan(&hit.RoomCode, &hit.CommentID, &lineNumber, &content); err != nil {
+				log.Printf("Error scanning search hit: %v", err)
+				continue
+			}
+			if lineNumber.Valid {
+				n := int(lineNumber.Int64)
+				hit.LineNumber = &n
+			}
+			hit.Content = content.String
+			hits = append(hits, hit)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+func (s *sqlStore) SaveMediaFile(roomCode string, media MediaFile) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO media_files (id, room_code, name, type, size, url, uploaded_at, uploaded_by, blob_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		media.ID, roomCode, media.Name, media.Type, media.Size,
+		media.URL, media.UploadedAt, media.UploadedBy, media.BlobHash)
+	return err
+}
+
+func (s *sqlStore) GetMediaFile(roomCode, mediaID string) (MediaFile, error) {
+	media := MediaFile{ID: mediaID}
+	err := s.db.QueryRow(s.q(`SELECT name, type, size, url, uploaded_at, uploaded_by, COALESCE(blob_hash, ''),
+		COALESCE(thumbnail_url, ''), COALESCE(width, 0), COALESCE(height, 0)
+		FROM media_files WHERE id = ? AND room_code = ?`), mediaID, roomCode).Scan(&media.Name, &media.Type, &media.Size,
+		&media.URL, &media.UploadedAt, &media.UploadedBy, &media.BlobHash,
+		&media.ThumbnailURL, &media.Width, &media.Height)
+	return media, err
+}
+
+func (s *sqlStore) UpdateMediaThumbnail(mediaID, thumbnailURL string, width, height int) error {
+	_, err := s.db.Exec(s.q("UPDATE media_files SET thumbnail_url = ?, width = ?, height = ? WHERE id = ?"),
+		thumbnailURL, width, height, mediaID)
+	return err
+}
+
+func (s *sqlStore) DeleteMediaFile(mediaID string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM media_files WHERE id = ?"), mediaID)
+	return err
+}
+
+func (s *sqlStore) GetRoomMedia(roomCode string) ([]MediaFile, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, name, type, size, url, uploaded_at, uploaded_by, COALESCE(blob_hash, ''),
+		COALESCE(thumbnail_url, ''), COALESCE(width, 0), COALESCE(height, 0)
+		FROM media_files WHERE room_code = ? ORDER BY uploaded_at ASC`), roomCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mediaFiles []MediaFile
+	for rows.Next() {
+		var media MediaFile
+		err := rows.Scan(&media.ID, &media.Name, &media.Type, &media.Size,
+			&media.URL, &media.UploadedAt, &media.UploadedBy, &media.BlobHash,
+			&media.ThumbnailURL, &media.Width, &media.Height)
+		if err != nil {
+			log.Printf("Error scanning media file: %v", err)
+			continue
+		}
+		mediaFiles = append(mediaFiles, media)
+	}
+	return mediaFiles, nil
+}
+
+func (s *sqlStore) RoomMediaSize(roomCode string) (int64, error) {
+	var size int64
+	err := s.db.QueryRow(s.q("SELECT COALESCE(SUM(size), 0) FROM media_files WHERE room_code = ?"), roomCode).Scan(&size)
+	return size, err
+}
+
+func (s *sqlStore) DeleteRoomMedia(roomCode string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM media_files WHERE room_code = ?"), roomCode)
+	return err
+}
+
+func (s *sqlStore) AddBlobRef(hash string, size int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(s.q("UPDATE blobs SET ref_count = ref_count + 1 WHERE hash = ?"), hash)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if updated == 0 {
+		_, err = tx.Exec(s.q("INSERT INTO blobs (hash, size, ref_count, created_at) VALUES (?, ?, 1, ?)"), hash, size, time.Now())
+		if err != nil {
+			return false, err
+		}
+	}
+	return updated == 0, tx.Commit()
+}
+
+func (s *sqlStore) ReleaseBlob(hash string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.q("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ?"), hash); err != nil {
+		return false, err
+	}
+	var refCount int
+	err = tx.QueryRow(s.q("SELECT ref_count FROM blobs WHERE hash = ?"), hash).Scan(&refCount)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if refCount <= 0 {
+		if _, err := tx.Exec(s.q("DELETE FROM blobs WHERE hash = ?"), hash); err != nil {
+			return false, err
+		}
+	}
+	return refCount <= 0, tx.Commit()
+}
+
+func (s *sqlStore) SaveUpload(upload ResumableUpload) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO uploads (id, room_code, name, type, uploaded_by, filename, upload_length, upload_offset, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		upload.ID, upload.RoomCode, upload.Name, upload.Type, upload.UploadedBy,
+		upload.Filename, upload.Length, upload.Offset, upload.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) GetUpload(id string) (ResumableUpload, error) {
+	var upload ResumableUpload
+	err := s.db.QueryRow(s.q(`SELECT id, room_code, name, type, uploaded_by, filename, upload_length, upload_offset, created_at
+		FROM uploads WHERE id = ?`), id).Scan(&upload.ID, &upload.RoomCode, &upload.Name, &upload.Type,
+		&upload.UploadedBy, &upload.Filename, &upload.Length, &upload.Offset, &upload.CreatedAt)
+	return upload, err
+}
+
+func (s *sqlStore) UpdateUploadOffset(id string, offset int64) error {
+	_, err := s.db.Exec(s.q("UPDATE uploads SET upload_offset = ? WHERE id = ?"), offset, id)
+	return err
+}
+
+func (s *sqlStore) DeleteUpload(id string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM uploads WHERE id = ?"), id)
+	return err
+}
+
+func (s *sqlStore) DeleteRoomUploads(roomCode string) error {
+	_, err := s.db.Exec(s.q("DELETE FROM uploads WHERE room_code = ?"), roomCode)
+	return err
+}
+
+func (s *sqlStore) RoomPendingUploadSize(roomCode string) (int64, error) {
+	var size int64
+	err := s.db.QueryRow(s.q("SELECT COALESCE(SUM(upload_length), 0) FROM uploads WHERE room_code = ?"), roomCode).Scan(&size)
+	return size, err
+}
+
+func (s *sqlStore) GetUploadsCreatedBefore(t time.Time) ([]ResumableUpload, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, room_code, name, type, uploaded_by, filename, upload_length, upload_offset, created_at
+		FROM uploads WHERE created_at < ?`), t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []ResumableUpload
+	for rows.Next() {
+		var upload ResumableUpload
+		if err := rows.Scan(&upload.ID, &upload.RoomCode, &upload.Name, &upload.Type, &upload.UploadedBy,
+			&upload.Filename, &upload.Length, &upload.Offset, &upload.CreatedAt); err != nil {
+			log.Printf("Error scanning upload: %v", err)
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// searchIndexSQL creates full-text indexes over room content and comments,
+// kept in step with their tables by triggers, and fills them.
+const searchIndexSQL = `
+CREATE VIRTUAL TABLE IF NOT EXISTS rooms_fts USING fts5(content, content='rooms', content_rowid='rowid');
+
+CREATE TRIGGER IF NOT EXISTS rooms_fts_insert AFTER INSERT ON rooms BEGIN
+	INSERT INTO rooms_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS rooms_fts_delete AFTER DELETE ON rooms BEGIN
+	INSERT INTO rooms_fts (rooms_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS rooms_fts_update AFTER UPDATE OF content ON rooms BEGIN
+	INSERT INTO rooms_fts (rooms_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+	INSERT INTO rooms_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+
+CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(content, content='comments', content_rowid='rowid');
+
+CREATE TRIGGER IF NOT EXISTS comments_fts_insert AFTER INSERT ON comments BEGIN
+	INSERT INTO comments_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS comments_fts_delete AFTER DELETE ON comments BEGIN
+	INSERT INTO comments_fts (comments_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS comments_fts_update AFTER UPDATE OF content ON comments BEGIN
+	INSERT INTO comments_fts (comments_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+	INSERT INTO comments_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+
+INSERT INTO rooms_fts (rooms_fts) VALUES ('rebuild');
+INSERT INTO comments_fts (comments_fts) VALUES ('rebuild');
+`
+
+// dropSearchTriggersSQL stops maintaining the indexes, which a build without
+// FTS5 can't write to. They are rebuilt when FTS5 is next available.
+const dropSearchTriggersSQL = `
+DROP TRIGGER IF EXISTS rooms_fts_insert;
+DROP TRIGGER IF EXISTS rooms_fts_delete;
+DROP TRIGGER IF EXISTS rooms_fts_update;
+DROP TRIGGER IF EXISTS comments_fts_insert;
+DROP TRIGGER IF EXISTS comments_fts_delete;
+DROP TRIGGER IF EXISTS comments_fts_update;
+`
+
+func newSQLiteStore(path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// go-sqlite3 only compiles in FTS5 on request
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !fts5 {
+		log.Printf("Warning: SQLite was built without FTS5, so search scans rooms instead of using an index; build with -tags sqlite_fts5")
+	}
+	return &sqlStore{db: db, dialect: "sqlite", fts5: fts5}, nil
+}
+
+// setupSearchIndex runs after migrating. With FTS5 it creates the search
+// index of migration 0010 if that was skipped by a build without FTS5, and
+// without FTS5 it makes sure nothing tries to maintain the index.
+func (s *sqlStore) setupSearchIndex() error {
+	if s.dialect != "sqlite" {
+		return nil
+	}
+	if !s.fts5 {
+		_, err := s.db.Exec(dropSearchTriggersSQL)
+		return err
+	}
+
+	var triggers int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'trigger' AND name LIKE '%\_fts\_%' ESCAPE '\'`).Scan(&triggers)
+	if err != nil || triggers == 6 {
+		return err
+	}
+	_, err = s.db.Exec(searchIndexSQL)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails are made by a background worker after an image upload has been
+// announced, and kept beside the blob as <blob>.thumb so files with the same
+// content share one. Clients learn of them through a media-update message.
+
+const (
+	// Longest side of a thumbnail in pixels.
+	thumbnailSize = 256
+	// Images with more pixels than this get their dimensions recorded but no
+	// thumbnail. Decoding takes up to 4 bytes a pixel, and with a single
+	// worker only one image is decoded at a time, so this bounds thumbnail
+	// memory at about 64 MB.
+	maxThumbnailPixels = 16 << 20
+	// Images waiting for the worker. Uploads beyond this go without a
+	// thumbnail rather than holding up the request.
+	thumbnailQueueSize = 64
+)
+
+type thumbnailJob struct {
+	RoomCode string
+	Media    MediaFile
+}
+
+var thumbnailJobs = make(chan thumbnailJob, thumbnailQueueSize)
+
+func thumbnailPath(hash string) string {
+	return blobPath(hash) + ".thumb"
+}
+
+// queueThumbnail hands an uploaded file to the thumbnail worker if it is an
+// image.
+func queueThumbnail(roomCode string, media MediaFile) {
+	if !strings.HasPrefix(media.Type, "image/") || media.BlobHash == "" {
+		return
+	}
+	select {
+	case thumbnailJobs <- thumbnailJob{RoomCode: roomCode, Media: media}:
+	default:
+		log.Printf("Thumbnail queue full, skipping %s in room %s", media.ID, roomCode)
+	}
+}
+
+func startThumbnailWorker() {
+	for job := range thumbnailJobs {
+		processThumbnail(job.RoomCode, job.Media)
+	}
+}
+
+func processThumbnail(roomCode string, media MediaFile) {
+	width, height, err := makeThumbnail(media.BlobHash)
+	if err != nil {
+		// Formats without a decoder, such as SVG, end up here too
+		log.Printf("Could not make thumbnail for %s in room %s: %v", media.ID, roomCode, err)
+		return
+	}
+
+	media.Width, media.Height = width, height
+	if _, err := os.Stat(thumbnailPath(media.BlobHash)); err == nil {
+		media.ThumbnailURL = fmt.Sprintf("/files/%s/%s/thumbnail", roomCode, media.ID)
+	}
+	if err := store.UpdateMediaThumbnail(media.ID, media.ThumbnailURL, media.Width, media.Height); err != nil {
+		log.Printf("Error saving thumbnail for %s: %v", media.ID, err)
+		return
+	}
+
+	rooms.do(roomCode, func(room *Room) {
+		for i := range room.MediaFiles {
+			if room.MediaFiles[i].ID != media.ID {
+				continue
+			}
+			// Replace the list rather than writing to it, since a media-sync
+			// may still be waiting to send the old one
+			mediaFiles := slices.Clone(room.MediaFiles)
+			mediaFiles[i] = media
+			room.MediaFiles = mediaFiles
+			updateMsg := MediaMessage{
+				BaseMessage: BaseMessage{Type: MediaUpdate, Code: roomCode},
+				Media:       media,
+			}
+			broadcastToRoom(room, updateMsg, "")
+			return
+		}
+	})
+}
+
+// makeThumbnail returns the dimensions of the image in the blob hash and makes
+// sure it has a thumbnail, unless the image is too large to decode.
+func makeThumbnail(hash string) (width, height int, err error) {
+	f, err := os.Open(blobPath(hash))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height = config.Width, config.Height
+	if width <= 0 || height <= 0 || width*height > maxThumbnailPixels {
+		return width, height, nil
+	}
+	if _, err := os.Stat(thumbnailPath(hash)); err == nil {
+		// Made already for another upload of the same file
+		return width, height, nil
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, 0, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Scale to fit within thumbnailSize, never up
+	tw, th := width, height
+	if tw > thumbnailSize || th > thumbnailSize {
+		if tw >= th {
+			tw, th = thumbnailSize, max(1, height*thumbnailSize/width)
+		} else {
+			tw, th = max(1, width*thumbnailSize/height), thumbnailSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	return width, height, saveThumbnail(hash, dst)
+}
+
+// saveThumbnail writes img as the thumbnail for a blob, as a PNG if it has
+// transparency and a JPEG otherwise.
+func saveThumbnail(hash string, img *image.RGBA) error {
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath(hash)), "thumb-*")
+	if err != nil {
+		return err
+	}
+	if img.Opaque() {
+		err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(tmp, img)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The last reference to the blob may have gone while we worked, and the
+	// thumbnail must not outlive it
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+	if _, err := os.Stat(blobPath(hash)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), thumbnailPath(hash))
+}
+
+func handleThumbnailServe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomCode, fileID := r.PathValue("code"), r.PathValue("id")
+
+	media, err := store.GetMediaFile(roomCode, fileID)
+	if err == sql.ErrNoRows || err == nil && media.ThumbnailURL == "" {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving media file %s: %v", fileID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Thumbnails are shown inline and never change for a given file
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, thumbnailPath(media.BlobHash))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// User IDs are chosen by clients, so on its first join with an ID a client
+// is issued a token for it, and later joins may only use the ID if they
+// present that token. Everything keyed by user ID, such as room roles,
+// comment authorship and search, relies on this. IDs that were in use before
+// tokens were introduced are known to everyone in their rooms, so whoever
+// claims one first gets it without the roles it held.
+
+// UserTokenMessage hands a client the token for its user ID. It is sent only
+// when the token is issued, and the client must keep it.
+type UserTokenMessage struct {
+	BaseMessage
+	UserID string `json:"userId"`
+	Token  string `json:"token"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimUserID reports whether a client presenting token may use userID. If
+// the ID is new a token is issued for it and returned.
+func claimUserID(userID, token string) (issued string, ok bool) {
+	if verifyUserToken(userID, token) {
+		return "", true
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating token for user %s: %v", userID, err)
+		return "", false
+	}
+	issued = hex.EncodeToString(buf)
+	saved, err := store.SaveUserToken(userID, hashToken(issued))
+	if err != nil {
+		log.Printf("Error saving token for user %s: %v", userID, err)
+		return "", false
+	}
+	if !saved {
+		// The ID already has a token, and this isn't it
+		return "", false
+	}
+	demoteUser(userID)
+	return issued, true
+}
+
+// demoteUser takes away any role above member that userID held before it had
+// a token, in the store and in rooms that are loaded.
+func demoteUser(userID string) {
+	codes, err := store.DemoteUser(userID)
+	if err != nil {
+		log.Printf("Error demoting user %s: %v", userID, err)
+		return
+	}
+	for _, code := range codes {
+		log.Printf("User %s claimed without a token, demoted in room %s", userID, code)
+		rooms.call(code, func(room *Room) {
+			if member, exists := room.Members[userID]; exists {
+				member.Role = RoleMember
+			}
+		})
+	}
+}
+
+// requestHasToken reports whether r carries the token issued for userID in an
+// Authorization: Bearer header.
+func requestHasToken(r *http.Request, userID string) bool {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return verifyUserToken(userID, token)
+}
+
+// verifyUserToken reports whether token is the one issued for userID.
+func verifyUserToken(userID, token string) bool {
+	if token == "" {
+		return false
+	}
+	tokenHash, err := store.GetUserToken(userID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error retrieving token for user %s: %v", userID, err)
+		}
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashToken(token))) == 1
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload),
+// version 1.0.0 with the creation, termination and expiration extensions. A
+// client POSTs to /o/tus/ with the file's length and metadata, then PATCHes
+// chunks to the returned URL, asking with HEAD where to carry on after a
+// dropped connection.
+const tusVersion = "1.0.0"
+
+// How long a resumable upload has to finish before it is discarded.
+const uploadExpiry = 24 * time.Hour
+
+// ResumableUpload is a tus upload in progress.
+type ResumableUpload struct {
+	ID         string
+	RoomCode   string
+	Name       string
+	Type       string
+	UploadedBy string
+	// Filename names the partial file in the room directory, which is
+	// Filename + ".part" until the upload completes.
+	Filename  string
+	Length    int64
+	Offset    int64
+	CreatedAt time.Time
+}
+
+func (u ResumableUpload) partPath() string {
+	return filepath.Join(filesDir, u.RoomCode, u.Filename+".part")
+}
+
+func (u ResumableUpload) expiresAt() time.Time {
+	return u.CreatedAt.Add(uploadExpiry)
+}
+
+// tusWriting holds the uploads a PATCH is currently writing to, since chunks
+// for one upload must be appended one at a time.
+var tusWriting = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+func lockUpload(id string) bool {
+	tusWriting.Lock()
+	defer tusWriting.Unlock()
+	if tusWriting.ids[id] {
+		return false
+	}
+	tusWriting.ids[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	tusWriting.Lock()
+	defer tusWriting.Unlock()
+	delete(tusWriting.ids, id)
+}
+
+// tusMiddleware adds the CORS and protocol headers tus clients need, answers
+// OPTIONS with the server's capabilities and turns away other protocol
+// versions.
+func tusMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addCORSHeaders(w, r)
+		h := w.Header()
+		h.Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Content-Type, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		h.Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Length, Upload-Offset, Upload-Expires")
+		h.Set("Tus-Resumable", tusVersion)
+
+		if r.Method == "OPTIONS" {
+			h.Set("Tus-Version", tusVersion)
+			h.Set("Tus-Extension", "creation,termination,expiration")
+			h.Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			h.Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// pairs of a key and an optional base64 value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("bad metadata value for %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// handleTusCreate starts a resumable upload. The room code, file name, file
+// type and uploader go in Upload-Metadata as roomCode, filename, filetype and
+// uploadedBy.
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, fmt.Sprintf("File exceeds the maximum upload size of %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	roomCode := metadata["roomCode"]
+	if !validRoomCode(roomCode) {
+		http.Error(w, "Room code is required", http.StatusBadRequest)
+		return
+	}
+	name := filepath.Base(metadata["filename"])
+	if name == "." || name == string(filepath.Separator) {
+		name = "upload"
+	}
+	uploadedBy := metadata["uploadedBy"]
+	if uploadedBy == "" {
+		uploadedBy = "Unknown"
+	}
+
+	fileID := fmt.Sprintf("file_%d_%d", time.Now().UnixNano(), rand.Intn(10000))
+	upload := ResumableUpload{
+		ID:         fileID,
+		RoomCode:   roomCode,
+		Name:       name,
+		Type:       metadata["filetype"],
+		UploadedBy: uploadedBy,
+		Filename:   fmt.Sprintf("%s_%s", fileID, name),
+		Length:     length,
+		CreatedAt:  time.Now(),
+	}
+
+	// Create room directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Join(filesDir, roomCode), 0755); err != nil {
+		http.Error(w, "Failed to create room directory", http.StatusInternalServerError)
+		return
+	}
+	part, err := os.Create(upload.partPath())
+	if err != nil {
+		log.Printf("Error creating upload %s: %v", upload.ID, err)
+		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		return
+	}
+	part.Close()
+
+	if err := saveUpload(upload); err != nil {
+		os.Remove(upload.partPath())
+		if errors.Is(err, errUploadTooLarge) {
+			http.Error(w, "Room upload quota exceeded", http.StatusRequestEntityTooLarge)
+		} else {
+			log.Printf("Error saving upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// An empty file is complete as soon as it exists
+	if length == 0 && !finishUpload(w, upload) {
+		return
+	}
+
+	w.Header().Set("Location", "/o/tus/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// saveUpload records a new upload, whose full length is reserved from the
+// room's quota straight away so that uploads in progress can't overrun it
+// between them. It returns errUploadTooLarge if there isn't room.
+func saveUpload(upload ResumableUpload) error {
+	uploadQuotaMutex.Lock()
+	defer uploadQuotaMutex.Unlock()
+
+	remaining, err := quotaRemaining(upload.RoomCode)
+	if err != nil {
+		return err
+	}
+	if upload.Length > remaining {
+		return errUploadTooLarge
+	}
+	return store.SaveUpload(upload)
+}
+
+// expireUploads discards uploads left unfinished for longer than
+// uploadExpiry.
+func expireUploads() {
+	uploads, err := store.GetUploadsCreatedBefore(time.Now().Add(-uploadExpiry))
+	if err != nil {
+		log.Printf("Error querying expired uploads: %v", err)
+		return
+	}
+
+	for _, upload := range uploads {
+		// One still being written is left for the next sweep
+		if !lockUpload(upload.ID) {
+			continue
+		}
+		os.Remove(upload.partPath())
+		if err := store.DeleteUpload(upload.ID); err != nil {
+			log.Printf("Error deleting expired upload %s: %v", upload.ID, err)
+		}
+		unlockUpload(upload.ID)
+		log.Printf("Expired upload %s in room %s", upload.ID, upload.RoomCode)
+	}
+}
+
+// handleTusUpload serves HEAD, PATCH and DELETE for a single upload.
+func handleTusUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case "HEAD":
+		upload, ok := getUpload(w, id)
+		if !ok {
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+
+	case "PATCH":
+		patchUpload(w, r, id)
+
+	case "DELETE":
+		if !lockUpload(id) {
+			http.Error(w, "Upload is being written", http.StatusLocked)
+			return
+		}
+		defer unlockUpload(id)
+
+		upload, ok := getUpload(w, id)
+		if !ok {
+			return
+		}
+		os.Remove(upload.partPath())
+		if err := store.DeleteUpload(id); err != nil {
+			log.Printf("Error deleting upload %s: %v", id, err)
+			http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getUpload loads an upload, writing the error response if it can't.
+func getUpload(w http.ResponseWriter, id string) (ResumableUpload, bool) {
+	upload, err := store.GetUpload(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving upload %s: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return upload, false
+	}
+	if time.Now().After(upload.expiresAt()) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return upload, false
+	}
+	return upload, true
+}
+
+// patchUpload appends a chunk to an upload. Whatever arrives is kept even if
+// the connection drops partway, so the client can resume from there.
+func patchUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	if !lockUpload(id) {
+		http.Error(w, "Upload is being written", http.StatusLocked)
+		return
+	}
+	defer unlockUpload(id)
+
+	upload, ok := getUpload(w, id)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	part, err := os.OpenFile(upload.partPath(), os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening upload %s: %v", id, err)
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	// Drop anything written after the last recorded offset, e.g. by a chunk
+	// that was cut off before its offset was saved
+	if err := part.Truncate(upload.Offset); err == nil {
+		_, err = part.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		part.Close()
+		log.Printf("Error preparing upload %s: %v", id, err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	n, copyErr := io.Copy(part, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	if err := part.Close(); copyErr == nil {
+		copyErr = err
+	}
+	if n > 0 {
+		upload.Offset += n
+		if err := store.UpdateUploadOffset(id, upload.Offset); err != nil {
+			log.Printf("Error saving offset of upload %s: %v", id, err)
+			http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+			return
+		}
+	}
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at offset %d: %v", id, upload.Offset, copyErr)
+		http.Error(w, "Upload interrupted", http.StatusBadRequest)
+		return
+	}
+
+	if upload.Offset == upload.Length && !finishUpload(w, upload) {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload registers a completed upload as a media file of its room, the
+// same way handleFileUpload does. On failure the upload is discarded and the
+// error response written.
+func finishUpload(w http.ResponseWriter, upload ResumableUpload) bool {
+	mediaFile := MediaFile{
+		ID:         upload.ID,
+		Name:       upload.Name,
+		Size:       upload.Length,
+		URL:        fmt.Sprintf("/files/%s/%s", upload.RoomCode, upload.ID),
+		UploadedAt: time.Now(),
+		UploadedBy: upload.UploadedBy,
+	}
+
+	// Chunks may have arrived over several connections, so the type and hash
+	// are only worked out once the file is complete
+	mediaType, err := detectUploadType(upload.partPath(), upload.Type)
+	if err == nil {
+		mediaFile.Type = mediaType
+		mediaFile.BlobHash, err = hashFile(upload.partPath())
+	}
+	if err == nil {
+		err = commitResumableUpload(upload, mediaFile)
+	}
+	if err != nil {
+		// The upload is over either way
+		os.Remove(upload.partPath())
+		if err := store.DeleteUpload(upload.ID); err != nil {
+			log.Printf("Error deleting failed upload %s: %v", upload.ID, err)
+		}
+	}
+	if errors.Is(err, errUploadType) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return false
+	}
+	if errors.Is(err, errUploadTooLarge) {
+		http.Error(w, "Room upload quota exceeded", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error saving upload %s to room %s: %v", upload.ID, upload.RoomCode, err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return false
+	}
+
+	announceMedia(upload.RoomCode, mediaFile)
+	queueThumbnail(upload.RoomCode, mediaFile)
+	return true
+}
+
+// commitResumableUpload commits a finished upload in place of its quota
+// reservation. Both happen under uploadQuotaMutex so that no other upload
+// can take the reserved space in between.
+func commitResumableUpload(upload ResumableUpload, media MediaFile) error {
+	uploadQuotaMutex.Lock()
+	defer uploadQuotaMutex.Unlock()
+
+	if err := commitUploadLocked(upload.RoomCode, upload.partPath(), media, upload.Length); err != nil {
+		return err
+	}
+	// Until this succeeds the file is counted twice; expireUploads cleans up
+	// if it doesn't
+	if err := store.DeleteUpload(upload.ID); err != nil {
+		log.Printf("Error deleting finished upload %s: %v", upload.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestStore points store and filesDir at a fresh SQLite database and
+// directory for the length of the test.
+func useTestStore(t *testing.T) {
+	t.Helper()
+	s, err := newSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore, oldFilesDir := store, filesDir
+	store, filesDir = s, t.TempDir()
+	t.Cleanup(func() {
+		store, filesDir = oldStore, oldFilesDir
+		s.Close()
+	})
+}
+
+func tusRequest(method, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/o/tus/{$}", tusMiddleware(handleTusCreate))
+	mux.HandleFunc("/o/tus/{id}", tusMiddleware(handleTusUpload))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func uploadMetadata(roomCode, filename string) string {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	return "roomCode " + encode(roomCode) + ",filename " + encode(filename) + ",filetype " + encode("text/plain")
+}
+
+// createUpload starts an upload of length bytes and returns its URL.
+func createUpload(t *testing.T, roomCode string, length int) string {
+	t.Helper()
+	rec := tusRequest("POST", "/o/tus/", "", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": uploadMetadata(roomCode, "notes.txt"),
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")
+}
+
+func patchChunk(url string, offset int, chunk string) *httptest.ResponseRecorder {
+	return tusRequest("PATCH", url, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+func TestTusCreate(t *testing.T) {
+	useTestStore(t)
+	defer func(quota int64) { roomUploadQuota = quota }(roomUploadQuota)
+	roomUploadQuota = 100
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"created", map[string]string{"Upload-Length": "10", "Upload-Metadata": uploadMetadata("room", "a.txt")}, http.StatusCreated},
+		{"wrong version", map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "10", "Upload-Metadata": uploadMetadata("room", "a.txt")}, http.StatusPreconditionFailed},
+		{"no length", map[string]string{"Upload-Metadata": uploadMetadata("room", "a.txt")}, http.StatusBadRequest},
+		{"no room", map[string]string{"Upload-Length": "10", "Upload-Metadata": uploadMetadata("", "a.txt")}, http.StatusBadRequest},
+		{"bad metadata", map[string]string{"Upload-Length": "10", "Upload-Metadata": "roomCode !!"}, http.StatusBadRequest},
+		{"over the quota", map[string]string{"Upload-Length": "91", "Upload-Metadata": uploadMetadata("room", "a.txt")}, http.StatusRequestEntityTooLarge},
+		{"within the rest of the quota", map[string]string{"Upload-Length": "90", "Upload-Metadata": uploadMetadata("room", "a.txt")}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := tusRequest("POST", "/o/tus/", "", tt.headers)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusCreated {
+				return
+			}
+			if !strings.HasPrefix(rec.Header().Get("Location"), "/o/tus/") || rec.Header().Get("Upload-Expires") == "" {
+				t.Errorf("got Location %q and Upload-Expires %q", rec.Header().Get("Location"), rec.Header().Get("Upload-Expires"))
+			}
+		})
+	}
+}
+
+func TestTusPatchAndHead(t *testing.T) {
+	useTestStore(t)
+	url := createUpload(t, "room", 11)
+
+	head := func(wantOffset string) {
+		t.Helper()
+		rec := tusRequest("HEAD", url, "", nil)
+		if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != wantOffset || rec.Header().Get("Upload-Length") != "11" {
+			t.Fatalf("HEAD returned %d with offset %q and length %q, want offset %s", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"), wantOffset)
+		}
+	}
+	head("0")
+
+	if rec := patchChunk(url, 0, "hello"); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk returned %d with offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	head("5")
+
+	if rec := patchChunk(url, 3, "lo world"); rec.Code != http.StatusConflict {
+		t.Errorf("chunk at a stale offset returned %d, want %d", rec.Code, http.StatusConflict)
+	}
+	rec := tusRequest("PATCH", url, " world", map[string]string{"Upload-Offset": "5"})
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("chunk without the tus content type returned %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+	head("5")
+
+	// Anything past the upload's length is ignored
+	if rec := patchChunk(url, 5, " world and more"); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("last chunk returned %d with offset %q: %s", rec.Code, rec.Header().Get("Upload-Offset"), rec.Body)
+	}
+
+	id := strings.TrimPrefix(url, "/o/tus/")
+	media, err := store.GetMediaFile("room", id)
+	if err != nil {
+		t.Fatalf("finished upload wasn't saved: %v", err)
+	}
+	if media.Size != 11 || media.Name != "notes.txt" {
+		t.Errorf("saved %d bytes named %q", media.Size, media.Name)
+	}
+	if data, err := os.ReadFile(blobPath(media.BlobHash)); err != nil || string(data) != "hello world" {
+		t.Errorf("stored %q, %v", data, err)
+	}
+	if rec := tusRequest("HEAD", url, "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a finished upload returned %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestTusFinishWithinReservedQuota(t *testing.T) {
+	useTestStore(t)
+	defer func(quota int64) { roomUploadQuota = quota }(roomUploadQuota)
+	roomUploadQuota = 10
+
+	url := createUpload(t, "room", 10)
+	rec := tusRequest("POST", "/o/tus/", "", map[string]string{"Upload-Length": "1", "Upload-Metadata": uploadMetadata("room", "b.txt")})
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("create while the quota is reserved returned %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rec := patchChunk(url, 0, "0123456789"); rec.Code != http.StatusNoContent {
+		t.Fatalf("upload filling the quota returned %d: %s", rec.Code, rec.Body)
+	}
+	if remaining, err := quotaRemaining("room"); err != nil || remaining != 0 {
+		t.Errorf("got %d bytes of quota left, %v; want the file counted once", remaining, err)
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	useTestStore(t)
+	url := createUpload(t, "room", 10)
+	if rec := patchChunk(url, 0, "hello"); rec.Code != http.StatusNoContent {
+		t.Fatalf("chunk returned %d", rec.Code)
+	}
+	upload, err := store.GetUpload(strings.TrimPrefix(url, "/o/tus/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := tusRequest("DELETE", url, "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d", rec.Code)
+	}
+	if _, err := os.Stat(upload.partPath()); !os.IsNotExist(err) {
+		t.Errorf("partial file still exists: %v", err)
+	}
+	if rec := tusRequest("HEAD", url, "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE returned %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := patchChunk(url, 5, "world"); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH after DELETE returned %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := tusRequest("DELETE", url, "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	useTestStore(t)
+	url := createUpload(t, "room", 10)
+	fresh := createUpload(t, "room", 10)
+
+	upload, err := store.GetUpload(strings.TrimPrefix(url, "/o/tus/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload.CreatedAt = time.Now().Add(-uploadExpiry - time.Minute)
+	if err := store.DeleteUpload(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveUpload(upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := tusRequest("HEAD", url, "", nil); rec.Code != http.StatusGone {
+		t.Errorf("HEAD of an expired upload returned %d, want %d", rec.Code, http.StatusGone)
+	}
+	if rec := patchChunk(url, 0, "hello"); rec.Code != http.StatusGone {
+		t.Errorf("PATCH of an expired upload returned %d, want %d", rec.Code, http.StatusGone)
+	}
+
+	expireUploads()
+	if _, err := store.GetUpload(upload.ID); err != sql.ErrNoRows {
+		t.Errorf("expired upload is still recorded: %v", err)
+	}
+	if _, err := os.Stat(upload.partPath()); !os.IsNotExist(err) {
+		t.Errorf("expired partial file still exists: %v", err)
+	}
+	if rec := tusRequest("HEAD", fresh, "", nil); rec.Code != http.StatusOK {
+		t.Errorf("HEAD of an unexpired upload returned %d after the sweep", rec.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upload limits in bytes, set from MAX_UPLOAD_SIZE and ROOM_UPLOAD_QUOTA.
+var (
+	maxUploadSize   int64 = 10 << 20
+	roomUploadQuota int64 = 100 << 20
+)
+
+// Room for the form fields that come with a file, on top of maxUploadSize.
+const uploadFormOverhead = 64 << 10
+
+// Longest value accepted for a non-file form field.
+const maxFormValueSize = 1 << 10
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadQuotaMutex makes checking a room's quota and recording the new file
+// one step, so concurrent uploads can't both squeeze under it.
+var uploadQuotaMutex sync.Mutex
+
+// envBytes reads a size in bytes from the environment, or returns def if the
+// variable isn't set.
+func envBytes(name string, def int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of bytes, got %q", name, value)
+	}
+	return n, nil
+}
+
+// validRoomCode reports whether code can safely name a directory under
+// filesDir.
+func validRoomCode(code string) bool {
+	return code != "" && code == filepath.Base(code) && !strings.HasPrefix(code, ".")
+}
+
+// readFormValue reads a small form field from a multipart stream.
+func readFormValue(part *multipart.Part) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxFormValueSize {
+		return "", fmt.Errorf("form field %s is too long", part.FormName())
+	}
+	return string(data), nil
+}
+
+// stagedUpload is a file streamed to a temporary location under filesDir
+// while the rest of the form is read.
+type stagedUpload struct {
+	Path        string
+	Name        string
+	ContentType string
+	Size        int64
+	Hash        string
+}
+
+// stageUpload streams part to a temporary file, failing with
+// errUploadTooLarge as soon as more than limit bytes have arrived.
+func stageUpload(part *multipart.Part, limit int64) (*stagedUpload, error) {
+	tmpDir := filepath.Join(filesDir, ".incoming")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	dst, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, h), io.LimitReader(part, limit+1))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > limit {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return nil, err
+	}
+
+	return &stagedUpload{
+		Path:        dst.Name(),
+		Name:        part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+		Size:        size,
+		Hash:        hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func (u *stagedUpload) discard() {
+	os.Remove(u.Path)
+}
+
+// quotaRemaining returns how many more bytes roomCode may upload. Resumable
+// uploads in progress count at their full length.
+func quotaRemaining(roomCode string) (int64, error) {
+	used, err := store.RoomMediaSize(roomCode)
+	if err != nil {
+		return 0, err
+	}
+	pending, err := store.RoomPendingUploadSize(roomCode)
+	if err != nil {
+		return 0, err
+	}
+	return max(roomUploadQuota-used-pending, 0), nil
+}
+
+// isMaxBytesError reports whether err came from the request body exceeding
+// its http.MaxBytesReader limit.
+func isMaxBytesError(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// commitUpload moves a finished upload from path into the blob store and
+// records media, provided it fits within the room's quota. It returns
+// errUploadTooLarge if it doesn't.
+func commitUpload(roomCode, path string, media MediaFile) error {
+	uploadQuotaMutex.Lock()
+	defer uploadQuotaMutex.Unlock()
+	return commitUploadLocked(roomCode, path, media, 0)
+}
+
+// commitUploadLocked does the work of commitUpload with uploadQuotaMutex
+// held. The reserved bytes of the room's quota were already set aside for
+// this file and count as free.
+func commitUploadLocked(roomCode, path string, media MediaFile, reserved int64) error {
+	remaining, err := quotaRemaining(roomCode)
+	if err != nil {
+		return err
+	}
+	if media.Size > remaining+reserved {
+		return errUploadTooLarge
+	}
+
+	if err := storeBlob(path, media.BlobHash, media.Size); err != nil {
+		return err
+	}
+	if err := store.SaveMediaFile(roomCode, media); err != nil {
+		releaseBlob(media.BlobHash)
+		return err
+	}
+	return nil
+}
+
+// announceMedia adds a newly uploaded file to the room and tells its clients.
+func announceMedia(roomCode string, media MediaFile) {
+	rooms.do(roomCode, func(room *Room) {
+		room.MediaFiles = append(room.MediaFiles, media)
+
+		// Broadcast to all clients in the room
+		mediaMsg := MediaMessage{
+			BaseMessage: BaseMessage{Type: MediaUpload, Code: roomCode},
+			Media:       media,
+		}
+		broadcastToRoom(room, mediaMsg, "")
+	})
+}